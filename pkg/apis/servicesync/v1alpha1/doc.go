@@ -0,0 +1,6 @@
+// +k8s:deepcopy-gen=package
+// +groupName=servicesync.io
+
+//Package v1alpha1 contains the ServiceSync custom resource that describes a service to synchronize from a source
+//cluster into the destination cluster.
+package v1alpha1
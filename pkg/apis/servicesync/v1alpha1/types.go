@@ -0,0 +1,135 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+//ServiceSync synchronizes a service of a source cluster into the namespace of the ServiceSync.
+type ServiceSync struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ServiceSyncSpec   `json:"spec"`
+	Status ServiceSyncStatus `json:"status,omitempty"`
+}
+
+//ServiceSyncSpec describes the source service and the name of the destination service.
+type ServiceSyncSpec struct {
+	//SourceCluster is the name of one of the source clusters configured for the controller.
+	SourceCluster   string `json:"sourceCluster"`
+	SourceNamespace string `json:"sourceNamespace"`
+	SourceService   string `json:"sourceService"`
+	//DestinationName defaults to the name of the source service.
+	// +optional
+	DestinationName string `json:"destinationName,omitempty"`
+	//Adopt allows taking over an existing destination service that is not managed by servicesync.
+	// +optional
+	Adopt bool `json:"adopt,omitempty"`
+	//EndpointSlices reads and writes EndpointSlices instead of Endpoints.
+	// +optional
+	EndpointSlices bool `json:"endpointSlices,omitempty"`
+	//IPFamilies restricts the IP families that are synchronized. Empty synchronizes all families.
+	// +optional
+	IPFamilies []corev1.IPFamily `json:"ipFamilies,omitempty"`
+	//Headless creates a headless destination service and keeps the hostnames of the endpoints.
+	// +optional
+	Headless bool `json:"headless,omitempty"`
+	//EndpointMode is pod to copy the pod addresses of the source, node-port to point at the node ports of the source
+	//service on all source nodes, load-balancer to point at the load balancer ingresses of the source service or alias
+	//for an ExternalName service without endpoints. Defaults to pod.
+	// +optional
+	EndpointMode string `json:"endpointMode,omitempty"`
+	//NodeAddressType is the type of the source node addresses used in node-port mode. Defaults to InternalIP.
+	// +optional
+	NodeAddressType corev1.NodeAddressType `json:"nodeAddressType,omitempty"`
+	//DestinationType is the type of the destination service: Source, ClusterIP, Headless, NodePort, LoadBalancer or
+	//ExternalName. Defaults to Source, the type of the source service.
+	// +optional
+	DestinationType string `json:"destinationType,omitempty"`
+	//ExternalName is the external name of an ExternalName destination service. Defaults to the external name of the
+	//source service.
+	// +optional
+	ExternalName string `json:"externalName,omitempty"`
+	//ExternalNameTemplate is a Go template of the external name in alias mode, rendered with the Name, Namespace and
+	//Cluster of the source service and the Hostname and IP of its first load balancer ingress.
+	// +optional
+	ExternalNameTemplate string `json:"externalNameTemplate,omitempty"`
+}
+
+//ServiceSyncStatus is the observed state of a ServiceSync.
+type ServiceSyncStatus struct {
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	Conditions []ServiceSyncCondition `json:"conditions,omitempty"`
+}
+
+//ServiceSyncConditionType is the type of a ServiceSync condition.
+type ServiceSyncConditionType string
+
+const (
+	//ServiceSyncSynced is true when the destination service and endpoints are being synchronized.
+	ServiceSyncSynced ServiceSyncConditionType = "Synced"
+	//ServiceSyncSourceUnreachable is true when the source service cannot be read.
+	ServiceSyncSourceUnreachable ServiceSyncConditionType = "SourceUnreachable"
+	//ServiceSyncConflict is true when the destination service is already claimed by another ServiceSync or exists
+	//without being managed by servicesync.
+	ServiceSyncConflict ServiceSyncConditionType = "Conflict"
+)
+
+//ServiceSyncCondition describes one aspect of the state of a ServiceSync.
+type ServiceSyncCondition struct {
+	Type   ServiceSyncConditionType `json:"type"`
+	Status corev1.ConditionStatus   `json:"status"`
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+//ServiceSyncList is a list of ServiceSync objects.
+type ServiceSyncList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ServiceSync `json:"items"`
+}
+
+//SetCondition adds or replaces the condition of the same type. The last transition time is only changed when the
+//status of the condition changes.
+func (s *ServiceSyncStatus) SetCondition(c ServiceSyncCondition) {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type != c.Type {
+			continue
+		}
+		if s.Conditions[i].Status == c.Status {
+			c.LastTransitionTime = s.Conditions[i].LastTransitionTime
+		} else if c.LastTransitionTime.IsZero() {
+			c.LastTransitionTime = metav1.Now()
+		}
+		s.Conditions[i] = c
+		return
+	}
+	if c.LastTransitionTime.IsZero() {
+		c.LastTransitionTime = metav1.Now()
+	}
+	s.Conditions = append(s.Conditions, c)
+}
+
+//GetCondition returns the condition of the given type or nil if it is not set.
+func (s *ServiceSyncStatus) GetCondition(t ServiceSyncConditionType) *ServiceSyncCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == t {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
@@ -1,9 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/richardmcsong/servicesync/pkg/config"
 	"github.com/richardmcsong/servicesync/pkg/servicesync"
@@ -16,8 +21,44 @@ import (
 
 var checkFlags []string
 
+// mappingFlags are only required when no list of mappings, discovery or export is configured.
+var mappingFlags = map[string]bool{
+	"service":               true,
+	"rename-service":        true,
+	"source-namespace":      true,
+	"destination-namespace": true,
+}
+
 var (
 	cfgFile               string
+	selector              string
+	unmatchedPolicy       string
+	onDelete              string
+	adopt                 bool
+	endpointSlices        bool
+	ipFamilies            []string
+	headless              bool
+	endpointMode          string
+	nodeAddressType       string
+	resolverAddress       string
+	destinationType       string
+	externalName          string
+	externalNameTemplate  string
+	localSelector         string
+	failoverThreshold     int
+	sourceClusterName     string
+	gcInterval            time.Duration
+	gcDryRun              bool
+	dryRun                bool
+	leaderElect           bool
+	leaseDuration         time.Duration
+	renewDeadline         time.Duration
+	retryPeriod           time.Duration
+	leaseNamespace        string
+	leaseName             string
+	metricsAddress        string
+	healthAddress         string
+	watchThreshold        time.Duration
 	sourceName            string
 	sourceNamespace       string
 	destinationName       string
@@ -30,20 +71,73 @@ var c = &cobra.Command{
 	Use:   "servicesync",
 	Short: "servicesync is a tool to synchonize service definitions across cluster boundaries.",
 	Run: func(cmd *cobra.Command, args []string) {
-		servicesync.Run(viper.GetViper())
+		initSyncConfig(cmd)
+		servicesync.Run(signalContext(), viper.GetViper())
+	},
+}
+
+var controllerCmd = &cobra.Command{
+	Use:   "controller",
+	Short: "reconcile ServiceSync resources in the destination cluster against the configured source clusters.",
+	Run: func(cmd *cobra.Command, args []string) {
+		servicesync.RunController(signalContext(), viper.GetViper())
+	},
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "print a unified diff between the destination objects and the objects servicesync would write, without writing them.",
+	Long: `print a unified diff between the destination objects of the configured mappings and the objects servicesync would
+write. The writes are sent to the destination as server-side dry-runs, so nothing is changed. Exits with 1 if there are
+differences and with 2 if a mapping could not be diffed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initSyncConfig(cmd)
+		changed, err := servicesync.Diff(signalContext(), viper.GetViper(), os.Stdout)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(2)
+		}
+		if changed {
+			os.Exit(1)
+		}
+	},
+}
+
+var onceCmd = &cobra.Command{
+	Use:   "once",
+	Short: "create and sync the destination objects of all mappings once, print a JSON summary of the changes and exit.",
+	Long: `create and sync the destination objects of all configured, discovered and exported mappings once without
+watching the sources, e.g. from a CronJob. A JSON summary of the changed destination objects is printed. Exits with 1 if
+a mapping could not be synced.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initSyncConfig(cmd)
+		summary, err := servicesync.Once(signalContext(), viper.GetViper())
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		if err := out.Encode(summary); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		if summary.Failed > 0 {
+			os.Exit(1)
+		}
 	},
 }
 
 func addStringVarP(c *cobra.Command, p *string, name, shorthand, value, usage string) error {
-	c.Flags().StringVarP(p, name, shorthand, value, usage)
+	c.PersistentFlags().StringVarP(p, name, shorthand, value, usage)
 	checkFlags = append(checkFlags, name)
-	return viper.BindPFlag(name, c.Flags().Lookup(name))
+	return viper.BindPFlag(name, c.PersistentFlags().Lookup(name))
 }
 
 func addStringVar(c *cobra.Command, p *string, name, value, usage string) error {
-	c.Flags().StringVar(p, name, value, usage)
+	c.PersistentFlags().StringVar(p, name, value, usage)
 	checkFlags = append(checkFlags, name)
-	return viper.BindPFlag(name, c.Flags().Lookup(name))
+	return viper.BindPFlag(name, c.PersistentFlags().Lookup(name))
 }
 
 // Execute the cli
@@ -51,19 +145,97 @@ func Execute() {
 	logrus.Infof("Starting service sync version: %s", config.Version)
 	logrus.SetLevel(logrus.DebugLevel)
 	cobra.OnInitialize(initConfig)
-	c.Flags().StringVarP(&cfgFile, "config", "c", "", "path to config file") // not strictly necessary -- all other configurations are necessary.
-	viper.BindPFlag("config", c.Flags().Lookup("config"))
+	c.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "path to config file") // not strictly necessary -- all other configurations are necessary.
+	viper.BindPFlag("config", c.PersistentFlags().Lookup("config"))
+	c.PersistentFlags().StringVar(&destinationKubeConfig, "destination-kube-config", "", "path to kubeconfig file for destination cluster. Defaults to the current kube context.")
+	viper.BindPFlag("destination-kube-config", c.PersistentFlags().Lookup("destination-kube-config"))
 	addStringVarP(c, &sourceName, "service", "s", "", "name of the source service to be synchronized from the source cluster")
 	addStringVar(c, &destinationName, "rename-service", "", "name of the destination service in the destination cluster")
 	addStringVar(c, &sourceKubeConfig, "source-kube-config", "", "path to kubeconfig file for source cluster")
-	addStringVar(c, &destinationKubeConfig, "destination-kube-config", "", "path to kubeconfig file for destination cluster. Defaults to the current kube context.")
 	addStringVar(c, &sourceNamespace, "source-namespace", "", "namespace of source service.")
 	addStringVar(c, &destinationNamespace, "destination-namespace", "", "namespace of target service.")
+	// selector and unmatched-policy are optional and replace service when set.
+	c.PersistentFlags().StringVar(&selector, "selector", "", "label selector of source services to discover and synchronize instead of a single service")
+	viper.BindPFlag("selector", c.PersistentFlags().Lookup("selector"))
+	c.PersistentFlags().StringVar(&unmatchedPolicy, "unmatched-policy", "delete", "what to do with destination objects of discovered services that stop matching the selector. One of delete, keep")
+	viper.BindPFlag("unmatched-policy", c.PersistentFlags().Lookup("unmatched-policy"))
+	c.PersistentFlags().StringVar(&onDelete, "on-delete", "keep", "what to do with the destination objects when the source service or endpoints are deleted. One of keep, delete, blank")
+	viper.BindPFlag("on-delete", c.PersistentFlags().Lookup("on-delete"))
+	c.PersistentFlags().BoolVar(&adopt, "adopt", false, "take over an existing destination service and endpoints that are not managed by servicesync")
+	viper.BindPFlag("adopt", c.PersistentFlags().Lookup("adopt"))
+	c.PersistentFlags().BoolVar(&endpointSlices, "endpoint-slices", false, "read the EndpointSlices of the source service and write EndpointSlices to the destination instead of Endpoints")
+	viper.BindPFlag("endpoint-slices", c.PersistentFlags().Lookup("endpoint-slices"))
+	c.PersistentFlags().StringSliceVar(&ipFamilies, "ip-families", nil, "IP families to synchronize, IPv4 and/or IPv6. Defaults to all families")
+	viper.BindPFlag("ip-families", c.PersistentFlags().Lookup("ip-families"))
+	c.PersistentFlags().BoolVar(&headless, "headless", false, "create a headless destination service and keep the hostnames of the endpoints so that each endpoint has its own DNS name")
+	viper.BindPFlag("headless", c.PersistentFlags().Lookup("headless"))
+	c.PersistentFlags().StringVar(&endpointMode, "endpoint-mode", "pod", "which addresses the destination endpoints point to. One of pod, node-port, load-balancer, alias. node-port uses the node ports of the source service on all source nodes for pod networks that are not routable, load-balancer uses the load balancer ingresses of the source service, alias creates an ExternalName service without endpoints")
+	viper.BindPFlag("endpoint-mode", c.PersistentFlags().Lookup("endpoint-mode"))
+	c.PersistentFlags().StringVar(&nodeAddressType, "node-address-type", "InternalIP", "type of the source node addresses used by endpoint-mode node-port. One of InternalIP, ExternalIP")
+	viper.BindPFlag("node-address-type", c.PersistentFlags().Lookup("node-address-type"))
+	c.PersistentFlags().StringVar(&destinationType, "destination-type", "Source", "type of the destination service. One of Source, ClusterIP, Headless, NodePort, LoadBalancer, ExternalName. Source uses the type of the source service")
+	viper.BindPFlag("destination-type", c.PersistentFlags().Lookup("destination-type"))
+	c.PersistentFlags().StringVar(&externalName, "external-name", "", "external name of an ExternalName destination service. Defaults to the external name of the source service")
+	viper.BindPFlag("external-name", c.PersistentFlags().Lookup("external-name"))
+	c.PersistentFlags().StringVar(&externalNameTemplate, "external-name-template", "", "Go template of the external name in endpoint-mode alias, rendered with .Name, .Namespace, .Cluster, .Hostname and .IP of the source service. Defaults to its load balancer hostname")
+	viper.BindPFlag("external-name-template", c.PersistentFlags().Lookup("external-name-template"))
+	c.PersistentFlags().StringVar(&localSelector, "local-selector", "", "label selector of local pods in the destination namespace that are published in the destination endpoints in preference to the source endpoints")
+	viper.BindPFlag("local-selector", c.PersistentFlags().Lookup("local-selector"))
+	c.PersistentFlags().IntVar(&failoverThreshold, "failover-threshold", 1, "number of ready local pods below which the source endpoints are published along with the local ones")
+	viper.BindPFlag("failover-threshold", c.PersistentFlags().Lookup("failover-threshold"))
+	c.PersistentFlags().StringVar(&resolverAddress, "resolver", "", "address of the DNS server resolving load balancer hostnames in endpoint-mode load-balancer. Defaults to the system resolver")
+	viper.BindPFlag("resolver", c.PersistentFlags().Lookup("resolver"))
+	c.PersistentFlags().StringVar(&sourceClusterName, "source-cluster-name", "source", "name of the source cluster recorded on the destination objects")
+	viper.BindPFlag("source-cluster-name", c.PersistentFlags().Lookup("source-cluster-name"))
+	c.PersistentFlags().DurationVar(&gcInterval, "gc-interval", 0, "how often to delete managed destination objects whose mapping no longer exists. 0 disables garbage collection")
+	viper.BindPFlag("gc-interval", c.PersistentFlags().Lookup("gc-interval"))
+	c.PersistentFlags().BoolVar(&gcDryRun, "gc-dry-run", false, "only log the destination objects garbage collection would delete")
+	viper.BindPFlag("gc-dry-run", c.PersistentFlags().Lookup("gc-dry-run"))
+	c.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "send all writes to the destination cluster as server-side dry-runs and log the objects and changes instead of writing them")
+	viper.BindPFlag("dry-run", c.PersistentFlags().Lookup("dry-run"))
+	c.PersistentFlags().BoolVar(&leaderElect, "leader-elect", false, "only synchronize while holding a Lease in the destination cluster so that several replicas can run")
+	viper.BindPFlag("leader-elect", c.PersistentFlags().Lookup("leader-elect"))
+	c.PersistentFlags().DurationVar(&leaseDuration, "leader-elect-lease-duration", 15*time.Second, "how long standby replicas wait after the last renewal before taking over the Lease")
+	viper.BindPFlag("leader-elect-lease-duration", c.PersistentFlags().Lookup("leader-elect-lease-duration"))
+	c.PersistentFlags().DurationVar(&renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "how long the leader retries renewing the Lease before giving it up")
+	viper.BindPFlag("leader-elect-renew-deadline", c.PersistentFlags().Lookup("leader-elect-renew-deadline"))
+	c.PersistentFlags().DurationVar(&retryPeriod, "leader-elect-retry-period", 2*time.Second, "how often replicas try to acquire or renew the Lease")
+	viper.BindPFlag("leader-elect-retry-period", c.PersistentFlags().Lookup("leader-elect-retry-period"))
+	c.PersistentFlags().StringVar(&leaseNamespace, "leader-elect-namespace", "", "namespace of the Lease in the destination cluster. Defaults to the namespace of the pod")
+	viper.BindPFlag("leader-elect-namespace", c.PersistentFlags().Lookup("leader-elect-namespace"))
+	c.PersistentFlags().StringVar(&leaseName, "leader-elect-name", "servicesync", "name of the Lease in the destination cluster")
+	viper.BindPFlag("leader-elect-name", c.PersistentFlags().Lookup("leader-elect-name"))
+	c.PersistentFlags().StringVar(&metricsAddress, "metrics-address", ":9090", "address to serve prometheus metrics on /metrics. Empty disables the endpoint")
+	viper.BindPFlag("metrics-address", c.PersistentFlags().Lookup("metrics-address"))
+	c.PersistentFlags().StringVar(&healthAddress, "health-address", ":8081", "address to serve the /healthz and /readyz probes on. Empty disables the probes")
+	viper.BindPFlag("health-address", c.PersistentFlags().Lookup("health-address"))
+	c.PersistentFlags().DurationVar(&watchThreshold, "watch-failure-threshold", 5*time.Minute, "how long a watch of a source object may be down before /healthz fails")
+	viper.BindPFlag("watch-failure-threshold", c.PersistentFlags().Lookup("watch-failure-threshold"))
+	c.AddCommand(controllerCmd)
+	c.AddCommand(diffCmd)
+	c.AddCommand(onceCmd)
 	if err := c.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
 
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM so that syncs in flight can complete. A second
+// signal exits right away.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		logrus.Infof("received %s, shutting down", s)
+		cancel()
+		s = <-signals
+		logrus.Errorf("received %s again, exiting", s)
+		os.Exit(1)
+	}()
+	return ctx
+}
+
 func homeDir() string {
 	if h := os.Getenv("HOME"); h != "" {
 		return h
@@ -85,9 +257,16 @@ func initConfig() {
 	} else {
 		logrus.Debugf("Could not use config file: %s: %s", viper.ConfigFileUsed(), err)
 	}
+	if err := handleDefaultDestKubeConfig(viper.GetViper()); err != nil {
+		logrus.Errorf("could not load destination-kube-config: %s", err)
+		os.Exit(1)
+	}
+}
+
+// initSyncConfig loads and checks the configuration only needed when synchronizing from a single source cluster.
+func initSyncConfig(c *cobra.Command) {
 	// handle defaults
 	viper.SetDefault("rename-service", viper.Get("service"))
-	handleDefaultDestKubeConfig(viper.GetViper())
 	// load source-kube-config
 	sourcek, err := clientcmd.BuildConfigFromFlags("", viper.GetString("source-kube-config"))
 	if err != nil {
@@ -98,6 +277,9 @@ func initConfig() {
 	viper.Set("source-kube-config", sourcek)
 
 	for _, v := range checkFlags {
+		if mappingFlags[v] && (viper.IsSet("mappings") || viper.IsSet("discovery") || viper.IsSet("selector") || viper.IsSet("export")) {
+			continue
+		}
 		if !viper.IsSet(v) {
 			logrus.Errorf("required configuration \"%s\" not set", v)
 			c.Usage()
@@ -0,0 +1,47 @@
+package servicesync
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+//aliasData is what the external name template of a mapping in alias mode is rendered with.
+type aliasData struct {
+	Name      string
+	Namespace string
+	Cluster   string
+	// Hostname and IP are those of the first load balancer ingress of the source service, if any.
+	Hostname string
+	IP       string
+}
+
+//aliasName returns the external name of the destination service of a mapping in alias mode. A static external name
+//takes precedence over the template, and the template over the load balancer hostname of the source service.
+func aliasName(source *corev1.Service, m Mapping) (string, error) {
+	if m.ExternalName != "" {
+		return m.ExternalName, nil
+	}
+	data := aliasData{Name: source.Name, Namespace: source.Namespace, Cluster: m.SourceCluster}
+	if ingress := source.Status.LoadBalancer.Ingress; len(ingress) > 0 {
+		data.Hostname = ingress[0].Hostname
+		data.IP = ingress[0].IP
+	}
+	if m.ExternalNameTemplate == "" {
+		if data.Hostname == "" {
+			return "", fmt.Errorf("source service of mapping %s has no load balancer hostname yet, set external-name or external-name-template to alias it", m)
+		}
+		return data.Hostname, nil
+	}
+	t, err := template.New("external-name").Option("missingkey=error").Parse(m.ExternalNameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid external-name-template of mapping %s: %s", m, err)
+	}
+	var name bytes.Buffer
+	if err := t.Execute(&name, data); err != nil {
+		return "", fmt.Errorf("could not render external-name-template of mapping %s: %s", m, err)
+	}
+	return name.String(), nil
+}
@@ -0,0 +1,86 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAliasName(t *testing.T) {
+	source := loadBalancerService(corev1.LoadBalancerIngress{Hostname: "lb.example.com"})
+	tests := []struct {
+		name    string
+		m       Mapping
+		want    string
+		wantErr bool
+	}{
+		{name: "load balancer hostname", m: Mapping{}, want: "lb.example.com"},
+		{name: "static", m: Mapping{ExternalName: "static.example.com", ExternalNameTemplate: "{{ .Name }}"}, want: "static.example.com"},
+		{name: "template", m: Mapping{SourceCluster: "east", ExternalNameTemplate: "{{ .Name }}.{{ .Namespace }}.{{ .Cluster }}.example.com"}, want: "fooService.foo.east.example.com"},
+		{name: "unknown field", m: Mapping{ExternalNameTemplate: "{{ .Port }}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := aliasName(source, tt.m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if name != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, name)
+			}
+		})
+	}
+	if _, err := aliasName(loadBalancerService(), Mapping{}); err == nil {
+		t.Error("expected an error for a source without load balancer hostname")
+	}
+}
+
+func TestSyncAlias(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", EndpointMode: EndpointModeAlias}
+	sourceCS := fake.NewSimpleClientset(loadBalancerService(corev1.LoadBalancerIngress{Hostname: "lb-1.example.com"}))
+	targetCS := fake.NewSimpleClientset()
+	done, err := StartMapping(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectExternalName := func(want string) {
+		t.Helper()
+		s, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Spec.Type != corev1.ServiceTypeExternalName || s.Spec.ExternalName != want {
+			t.Errorf("expected an ExternalName service for %s, got %s %q", want, s.Spec.Type, s.Spec.ExternalName)
+		}
+	}
+	expectExternalName("lb-1.example.com")
+	if _, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "barService", metav1.GetOptions{}); err == nil {
+		t.Error("endpoints were created for an alias")
+	}
+
+	// the load balancer of the source is replaced
+	if _, err := sourceCS.CoreV1().Services("foo").UpdateStatus(ctx, loadBalancerService(corev1.LoadBalancerIngress{Hostname: "lb-2.example.com"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectExternalName("lb-2.example.com")
+	cancel()
+	<-done
+}
+
+func TestValidateAlias(t *testing.T) {
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", EndpointMode: EndpointModeAlias, ExternalNameTemplate: "{{ .Name"}
+	if err := m.validate(); err == nil {
+		t.Error("expected an invalid template to be rejected")
+	}
+	m = Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", EndpointMode: EndpointModeAlias, DestinationType: DestinationTypeClusterIP}
+	if err := m.validate(); err == nil {
+		t.Error("expected alias mode with a ClusterIP destination to be rejected")
+	}
+}
@@ -0,0 +1,415 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/richardmcsong/servicesync/pkg/apis/servicesync/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const controllerResyncPeriod = 30 * time.Second
+
+//Cluster is a source cluster that ServiceSync objects can refer to by name.
+type Cluster struct {
+	Name       string `mapstructure:"name"`
+	KubeConfig string `mapstructure:"kube-config"`
+}
+
+//ClustersFromConfig reads the list of source clusters under the "clusters" key.
+func ClustersFromConfig(v *viper.Viper) ([]Cluster, error) {
+	var clusters []Cluster
+	if err := v.UnmarshalKey("clusters", &clusters); err != nil {
+		return nil, fmt.Errorf("could not read clusters: %s", err)
+	}
+	for _, c := range clusters {
+		if c.Name == "" {
+			return nil, fmt.Errorf("cluster with kube-config %q has no name", c.KubeConfig)
+		}
+	}
+	return clusters, nil
+}
+
+//RunController reconciles ServiceSync objects in the destination cluster until ctx is done. It returns once the
+//reconciles and syncs in flight have completed.
+func RunController(ctx context.Context, v *viper.Viper) {
+	ServeMetrics(v)
+	ServeHealth(v)
+	ConfigureResolver(v)
+	ConfigureDryRun(v)
+	runWithLeaderElection(ctx, v, func(ctx context.Context) {
+		runController(ctx, v)
+	})
+	logrus.Info("stopped")
+}
+
+func runController(ctx context.Context, v *viper.Viper) {
+	targetConfig := v.Get("destination-kube-config").(*rest.Config)
+	targetCS, err := kubernetes.NewForConfig(targetConfig)
+	if err != nil {
+		logrus.Fatalf("unexpected error while creating destination client set: %s", err)
+	}
+	client, err := dynamic.NewForConfig(targetConfig)
+	if err != nil {
+		logrus.Fatalf("unexpected error while creating destination dynamic client: %s", err)
+	}
+	clusters, err := ClustersFromConfig(v)
+	if err != nil {
+		logrus.Fatalf("unexpected error while reading clusters: %s", err)
+	}
+	managers := map[string]*Manager{}
+	for _, c := range clusters {
+		config, err := clientcmd.BuildConfigFromFlags("", c.KubeConfig)
+		if err != nil {
+			logrus.Errorf("could not load kube-config of cluster %s: %s", c.Name, err)
+			continue
+		}
+		sourceCS, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			logrus.Errorf("error while building client set of cluster %s: %s", c.Name, err)
+			continue
+		}
+		managers[c.Name] = NewManager(c.Name, sourceCS, targetCS)
+	}
+	logrus.Infof("reconciling ServiceSync objects with %d source clusters", len(managers))
+	c := NewController(client, targetCS, managers)
+	done := c.Run(ctx, 1)
+	if interval := v.GetDuration("gc-interval"); interval > 0 {
+		for name := range managers {
+			go RunGarbageCollection(ctx, interval, name, c.inUse, targetCS, v.GetBool("gc-dry-run"))
+		}
+	}
+
+	<-ctx.Done()
+	health.SetReady(false)
+	logrus.Info("shutting down, waiting for reconciles and syncs in flight")
+	<-done
+	for _, mgr := range managers {
+		mgr.Wait()
+	}
+}
+
+//Controller starts a mapping for every ServiceSync object and writes the state of the mapping back to its status.
+type Controller struct {
+	client   dynamic.Interface
+	targetCS kubernetes.Interface
+	// managers holds a manager per source cluster, keyed by cluster name.
+	managers map[string]*Manager
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+
+	// running and claims are only accessed by the worker, see Run.
+	// running holds the last started mapping of each ServiceSync object, keyed by namespace/name of the ServiceSync. It
+	// is stopped but kept while the mapping of a changed spec cannot be started.
+	running map[string]runningSync
+	// claims holds the key of the ServiceSync that owns a destination, keyed by destination namespace/name.
+	claims map[string]string
+}
+
+type runningSync struct {
+	cluster string
+	mapping Mapping
+}
+
+//NewController creates a controller for the ServiceSync objects of the destination cluster.
+func NewController(client dynamic.Interface, targetCS kubernetes.Interface, managers map[string]*Manager) *Controller {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, controllerResyncPeriod)
+	c := &Controller{
+		client:   client,
+		targetCS: targetCS,
+		managers: managers,
+		informer: factory.ForResource(v1alpha1.ServiceSyncResource).Informer(),
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "servicesync"),
+		running:  map[string]runningSync{},
+		claims:   map[string]string{},
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+		DeleteFunc: c.enqueue,
+	})
+	return c
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logrus.Errorf("could not get key of ServiceSync: %s", err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+//Run starts the informer and the worker. The claims on destinations are kept in memory, so only a single worker is
+//supported. The returned channel is closed once ctx is done and the informer and the worker have stopped.
+func (c *Controller) Run(ctx context.Context, workers int) <-chan struct{} {
+	if workers != 1 {
+		logrus.Warnf("the ServiceSync controller only supports a single worker, ignoring %d", workers)
+	}
+	informerDone := make(chan struct{})
+	go func() {
+		defer close(informerDone)
+		c.informer.Run(ctx.Done())
+	}()
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+			return
+		}
+		health.SetReady(true)
+		wait.Until(func() {
+			for c.processNextItem(ctx) {
+			}
+		}, time.Second, ctx.Done())
+	}()
+	return joined(informerDone, workerDone)
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+	if ctx.Err() != nil {
+		// stopped, drop what is left in the queue
+		return false
+	}
+	if err := c.reconcile(ctx, key.(string)); err != nil {
+		logrus.Errorf("error while reconciling ServiceSync %s: %s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) reconcile(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		c.remove(ctx, key)
+		return nil
+	}
+	ss := &v1alpha1.ServiceSync{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).Object, ss); err != nil {
+		return err
+	}
+	status := ss.Status.DeepCopy()
+	status.ObservedGeneration = ss.Generation
+	syncErr := c.sync(ctx, key, ss, status)
+	if !reflect.DeepEqual(&ss.Status, status) {
+		ss.Status = *status
+		if err := c.updateStatus(ctx, ss); err != nil {
+			return err
+		}
+	}
+	return syncErr
+}
+
+//inUse returns whether the destination of the mapping belongs to an existing ServiceSync object, whether its mapping is
+//running or not. The destination of a ServiceSync whose mapping fails to start or is being restarted for a changed spec
+//is thereby kept by the garbage collection, as is every destination until the ServiceSync objects are listed.
+func (c *Controller) inUse(m Mapping) bool {
+	if !c.informer.HasSynced() {
+		return true
+	}
+	for _, obj := range c.informer.GetStore().List() {
+		ss := &v1alpha1.ServiceSync{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).Object, ss); err != nil {
+			logrus.Errorf("could not read ServiceSync, keeping the destination %s/%s: %s", m.DestinationNamespace, m.DestinationName, err)
+			return true
+		}
+		sm := serviceSyncMapping(ss)
+		sm.setDefaults()
+		if sm.DestinationNamespace == m.DestinationNamespace && sm.DestinationName == m.DestinationName {
+			return true
+		}
+	}
+	return false
+}
+
+//serviceSyncMapping returns the mapping of the spec of a ServiceSync.
+func serviceSyncMapping(ss *v1alpha1.ServiceSync) Mapping {
+	return Mapping{
+		SourceNamespace:      ss.Spec.SourceNamespace,
+		SourceName:           ss.Spec.SourceService,
+		DestinationNamespace: ss.Namespace,
+		DestinationName:      ss.Spec.DestinationName,
+		Adopt:                ss.Spec.Adopt,
+		EndpointSlices:       ss.Spec.EndpointSlices,
+		IPFamilies:           ss.Spec.IPFamilies,
+		Headless:             ss.Spec.Headless,
+		EndpointMode:         EndpointMode(ss.Spec.EndpointMode),
+		NodeAddressType:      ss.Spec.NodeAddressType,
+		DestinationType:      DestinationType(ss.Spec.DestinationType),
+		ExternalName:         ss.Spec.ExternalName,
+		ExternalNameTemplate: ss.Spec.ExternalNameTemplate,
+	}
+}
+
+//sync starts or restarts the mapping of the ServiceSync and records the outcome in status. A changed spec is synced to
+//the existing destination objects, and an invalid one leaves them as they are.
+func (c *Controller) sync(ctx context.Context, key string, ss *v1alpha1.ServiceSync, status *v1alpha1.ServiceSyncStatus) error {
+	m := serviceSyncMapping(ss)
+	m.setDefaults()
+	old, started := c.running[key]
+	if err := m.validate(); err != nil {
+		// the destination stays as it is, synchronized by the last valid spec if there was one
+		message := err.Error()
+		if started {
+			message += fmt.Sprintf(", still synchronizing the previous spec from %s/%s", old.mapping.SourceNamespace, old.mapping.SourceName)
+		}
+		setCondition(status, v1alpha1.ServiceSyncSynced, corev1.ConditionFalse, "InvalidSpec", message)
+		return nil
+	}
+	destination := m.DestinationNamespace + "/" + m.DestinationName
+
+	changed := started && (old.cluster != ss.Spec.SourceCluster || !reflect.DeepEqual(old.mapping, m))
+	var oldStopped <-chan struct{}
+	if changed {
+		// the spec changed, the new mapping continues from the destination objects of the old one once it starts
+		oldStopped = c.managers[old.cluster].Stop(old.mapping)
+	}
+	if owner, ok := c.claims[destination]; ok && owner != key {
+		setCondition(status, v1alpha1.ServiceSyncConflict, corev1.ConditionTrue, "DestinationClaimed", fmt.Sprintf("service %s is already synchronized by ServiceSync %s", destination, owner))
+		setCondition(status, v1alpha1.ServiceSyncSynced, corev1.ConditionFalse, "Conflict", "")
+		return nil
+	}
+	setCondition(status, v1alpha1.ServiceSyncConflict, corev1.ConditionFalse, "", "")
+
+	mgr, ok := c.managers[ss.Spec.SourceCluster]
+	if !ok {
+		setCondition(status, v1alpha1.ServiceSyncSourceUnreachable, corev1.ConditionTrue, "UnknownCluster", fmt.Sprintf("source cluster %q is not configured", ss.Spec.SourceCluster))
+		setCondition(status, v1alpha1.ServiceSyncSynced, corev1.ConditionFalse, "SourceUnreachable", "")
+		return nil
+	}
+	if _, err := mgr.sourceCS.CoreV1().Services(m.SourceNamespace).Get(ctx, m.SourceName, metav1.GetOptions{}); err != nil {
+		setCondition(status, v1alpha1.ServiceSyncSourceUnreachable, corev1.ConditionTrue, "SourceServiceUnavailable", err.Error())
+		setCondition(status, v1alpha1.ServiceSyncSynced, corev1.ConditionFalse, "SourceUnreachable", "")
+		return err
+	}
+	setCondition(status, v1alpha1.ServiceSyncSourceUnreachable, corev1.ConditionFalse, "", "")
+
+	start := m
+	sameDestination := started && old.mapping.DestinationNamespace == m.DestinationNamespace && old.mapping.DestinationName == m.DestinationName
+	if sameDestination {
+		// the destination objects were written by the old spec of this ServiceSync, which may have had another source
+		start.Adopt = true
+	}
+	if err := mgr.Start(ctx, start); err != nil {
+		if conflict, ok := err.(*ConflictError); ok {
+			setCondition(status, v1alpha1.ServiceSyncConflict, corev1.ConditionTrue, "DestinationUnmanaged", conflict.Error())
+			setCondition(status, v1alpha1.ServiceSyncSynced, corev1.ConditionFalse, "Conflict", "")
+			return err
+		}
+		setCondition(status, v1alpha1.ServiceSyncSynced, corev1.ConditionFalse, "SyncFailed", err.Error())
+		return err
+	}
+	if changed {
+		switch {
+		case !sameDestination:
+			// the ServiceSync moved to another destination, which has taken over by now
+			<-oldStopped
+			c.deleteDestination(ctx, key, old.mapping)
+		case old.mapping.EndpointSlices != m.EndpointSlices:
+			<-oldStopped
+			c.deleteEndpoints(ctx, key, old.mapping)
+		}
+	}
+	c.running[key] = runningSync{cluster: ss.Spec.SourceCluster, mapping: m}
+	c.claims[destination] = key
+	c.release(key, destination)
+	setCondition(status, v1alpha1.ServiceSyncSynced, corev1.ConditionTrue, "Synced", "")
+	return nil
+}
+
+//remove stops the mapping of a ServiceSync, deletes its destination objects and releases its claim.
+func (c *Controller) remove(ctx context.Context, key string) {
+	rs, ok := c.running[key]
+	if ok {
+		delete(c.running, key)
+		// a sync in flight would write the destination again
+		<-c.managers[rs.cluster].Stop(rs.mapping)
+		c.deleteDestination(ctx, key, rs.mapping)
+	}
+	c.release(key, "")
+}
+
+//deleteDestination deletes the destination service and endpoints or endpoint slices of the mapping of a ServiceSync.
+func (c *Controller) deleteDestination(ctx context.Context, key string, m Mapping) {
+	if err := DeleteService(ctx, m.DestinationNamespace, m.DestinationName, c.targetCS); err != nil {
+		logrus.Errorf("error while deleting service of ServiceSync %s: %s", key, err)
+	}
+	c.deleteEndpoints(ctx, key, m)
+}
+
+//deleteEndpoints deletes the destination endpoints or endpoint slices of the mapping of a ServiceSync.
+func (c *Controller) deleteEndpoints(ctx context.Context, key string, m Mapping) {
+	if m.EndpointSlices {
+		if err := DeleteEndpointSlices(ctx, m.DestinationNamespace, m.DestinationName, c.targetCS); err != nil {
+			logrus.Errorf("error while deleting endpoint slices of ServiceSync %s: %s", key, err)
+		}
+	} else if err := DeleteEndpoints(ctx, m.DestinationNamespace, m.DestinationName, c.targetCS); err != nil {
+		logrus.Errorf("error while deleting endpoints of ServiceSync %s: %s", key, err)
+	}
+}
+
+//release releases the claims of a ServiceSync on every destination but keep, and gives conflicting ServiceSync objects a
+//chance to claim them.
+func (c *Controller) release(key, keep string) {
+	for destination, owner := range c.claims {
+		if owner == key && destination != keep {
+			delete(c.claims, destination)
+			for _, k := range c.informer.GetIndexer().ListKeys() {
+				if k != key {
+					c.queue.Add(k)
+				}
+			}
+		}
+	}
+}
+
+func (c *Controller) updateStatus(ctx context.Context, ss *v1alpha1.ServiceSync) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ss)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: obj}
+	u.SetAPIVersion(v1alpha1.SchemeGroupVersion.String())
+	u.SetKind("ServiceSync")
+	_, err = c.client.Resource(v1alpha1.ServiceSyncResource).Namespace(ss.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+func setCondition(status *v1alpha1.ServiceSyncStatus, t v1alpha1.ServiceSyncConditionType, s corev1.ConditionStatus, reason, message string) {
+	status.SetCondition(v1alpha1.ServiceSyncCondition{
+		Type:    t,
+		Status:  s,
+		Reason:  reason,
+		Message: message,
+	})
+}
@@ -0,0 +1,168 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardmcsong/servicesync/pkg/apis/servicesync/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newServiceSync(name, cluster, destinationName string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(v1alpha1.SchemeGroupVersion.String())
+	u.SetKind("ServiceSync")
+	u.SetNamespace("bar")
+	u.SetName(name)
+	unstructured.SetNestedField(u.Object, cluster, "spec", "sourceCluster")
+	unstructured.SetNestedField(u.Object, "foo", "spec", "sourceNamespace")
+	unstructured.SetNestedField(u.Object, "fooService", "spec", "sourceService")
+	unstructured.SetNestedField(u.Object, destinationName, "spec", "destinationName")
+	return u
+}
+
+func getServiceSync(t *testing.T, client *dynamicfake.FakeDynamicClient, name string) *v1alpha1.ServiceSync {
+	u, err := client.Resource(v1alpha1.ServiceSyncResource).Namespace("bar").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &v1alpha1.ServiceSync{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, ss); err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func expectCondition(t *testing.T, ss *v1alpha1.ServiceSync, ct v1alpha1.ServiceSyncConditionType, status corev1.ConditionStatus) {
+	c := ss.Status.GetCondition(ct)
+	if c == nil {
+		t.Errorf("ServiceSync %s has no %s condition", ss.Name, ct)
+		return
+	}
+	if c.Status != status {
+		t.Errorf("ServiceSync %s should have %s=%s but found %s: %s", ss.Name, ct, status, c.Status, c.Message)
+	}
+}
+
+func TestController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	})
+	targetCS := fake.NewSimpleClientset()
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newServiceSync("synced", "one", "barService"),
+		newServiceSync("unreachable", "two", "otherService"),
+	)
+	c := NewController(client, targetCS, map[string]*Manager{"one": NewManager("source", sourceCS, targetCS)})
+	c.Run(ctx, 1)
+	time.Sleep(sleepLength)
+
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{}); err != nil {
+		t.Errorf("service of ServiceSync was not created: %s", err)
+	}
+	expectCondition(t, getServiceSync(t, client, "synced"), v1alpha1.ServiceSyncSynced, corev1.ConditionTrue)
+	unreachable := getServiceSync(t, client, "unreachable")
+	expectCondition(t, unreachable, v1alpha1.ServiceSyncSourceUnreachable, corev1.ConditionTrue)
+	expectCondition(t, unreachable, v1alpha1.ServiceSyncSynced, corev1.ConditionFalse)
+
+	if _, err := client.Resource(v1alpha1.ServiceSyncResource).Namespace("bar").Create(ctx, newServiceSync("conflict", "one", "barService"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectCondition(t, getServiceSync(t, client, "conflict"), v1alpha1.ServiceSyncConflict, corev1.ConditionTrue)
+
+	if err := client.Resource(v1alpha1.ServiceSyncResource).Namespace("bar").Delete(ctx, "synced", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	conflict := getServiceSync(t, client, "conflict")
+	expectCondition(t, conflict, v1alpha1.ServiceSyncConflict, corev1.ConditionFalse)
+	expectCondition(t, conflict, v1alpha1.ServiceSyncSynced, corev1.ConditionTrue)
+
+	// the garbage collection keeps the destinations of existing ServiceSync objects, running or not
+	if !c.inUse(Mapping{SourceCluster: "two", DestinationNamespace: "bar", DestinationName: "otherService"}) {
+		t.Error("expected the destination of the unreachable ServiceSync to be in use")
+	}
+	if c.inUse(Mapping{SourceCluster: "one", DestinationNamespace: "bar", DestinationName: "deletedService"}) {
+		t.Error("expected a destination without ServiceSync not to be in use")
+	}
+}
+
+func TestControllerSpecChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	}, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "otherService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "otherService", Namespace: "foo"},
+	})
+	targetCS := fake.NewSimpleClientset()
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newServiceSync("synced", "one", "barService"))
+	c := NewController(client, targetCS, map[string]*Manager{"one": NewManager("source", sourceCS, targetCS)})
+	c.Run(ctx, 1)
+	time.Sleep(sleepLength)
+	expectKept := func() {
+		t.Helper()
+		for _, action := range targetCS.Actions() {
+			if action.GetVerb() == "delete" {
+				t.Errorf("expected the destination to be kept, got %s of %s", action.GetVerb(), action.GetResource().Resource)
+			}
+		}
+	}
+	update := func(set func(u *unstructured.Unstructured)) {
+		t.Helper()
+		u, err := client.Resource(v1alpha1.ServiceSyncResource).Namespace("bar").Get(ctx, "synced", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		set(u)
+		if _, err := client.Resource(v1alpha1.ServiceSyncResource).Namespace("bar").Update(ctx, u, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(sleepLength)
+	}
+
+	// a typo in the spec leaves the destination alone
+	update(func(u *unstructured.Unstructured) {
+		unstructured.SetNestedField(u.Object, "typo", "spec", "endpointMode")
+	})
+	expectCondition(t, getServiceSync(t, client, "synced"), v1alpha1.ServiceSyncSynced, corev1.ConditionFalse)
+	expectKept()
+
+	// the fixed spec with another source takes over the destination objects
+	update(func(u *unstructured.Unstructured) {
+		unstructured.RemoveNestedField(u.Object, "spec", "endpointMode")
+		unstructured.SetNestedField(u.Object, "otherService", "spec", "sourceService")
+	})
+	expectCondition(t, getServiceSync(t, client, "synced"), v1alpha1.ServiceSyncSynced, corev1.ConditionTrue)
+	expectKept()
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Spec.Ports[0].Port != 8080 || s.Annotations[SourceNameAnnotation] != "otherService" {
+		t.Errorf("expected the destination to be synced from the new source, got %v", s)
+	}
+}
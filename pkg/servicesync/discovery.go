@@ -0,0 +1,223 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const discoveryRetryPeriod = 5 * time.Second
+
+//UnmatchedPolicy decides what happens to the destination objects of a discovered service that stops matching.
+type UnmatchedPolicy string
+
+const (
+	//UnmatchedDelete deletes the destination service and endpoints.
+	UnmatchedDelete UnmatchedPolicy = "delete"
+	//UnmatchedKeep stops synchronizing but leaves the destination service and endpoints as they are.
+	UnmatchedKeep UnmatchedPolicy = "keep"
+)
+
+//Discovery mirrors every source service that matches a label selector.
+type Discovery struct {
+	Selector         string   `mapstructure:"selector"`
+	SourceNamespaces []string `mapstructure:"source-namespaces"`
+	//DestinationNamespace defaults to the namespace of the discovered service.
+	DestinationNamespace string          `mapstructure:"destination-namespace"`
+	UnmatchedPolicy      UnmatchedPolicy `mapstructure:"unmatched-policy"`
+}
+
+func (d *Discovery) setDefaults() {
+	if d.UnmatchedPolicy == "" {
+		d.UnmatchedPolicy = UnmatchedDelete
+	}
+}
+
+func (d Discovery) validate() error {
+	if _, err := labels.Parse(d.Selector); err != nil {
+		return fmt.Errorf("discovery %q: invalid selector: %s", d.Selector, err)
+	}
+	switch d.UnmatchedPolicy {
+	case UnmatchedDelete, UnmatchedKeep:
+	default:
+		return fmt.Errorf("discovery %q: unknown unmatched-policy %q", d.Selector, d.UnmatchedPolicy)
+	}
+	return nil
+}
+
+//DiscoveriesFromConfig reads the list of discoveries under the "discovery" key. If no list is configured but a
+//top level selector is set, a single discovery is built from the selector, source-namespace, destination-namespace
+//and unmatched-policy keys.
+func DiscoveriesFromConfig(v *viper.Viper) ([]Discovery, error) {
+	var discoveries []Discovery
+	if v.IsSet("discovery") {
+		if err := v.UnmarshalKey("discovery", &discoveries); err != nil {
+			return nil, fmt.Errorf("could not read discovery: %s", err)
+		}
+	} else if v.IsSet("selector") {
+		d := Discovery{
+			Selector:             v.GetString("selector"),
+			DestinationNamespace: v.GetString("destination-namespace"),
+			UnmatchedPolicy:      UnmatchedPolicy(v.GetString("unmatched-policy")),
+		}
+		if ns := v.GetString("source-namespace"); ns != "" {
+			d.SourceNamespaces = []string{ns}
+		}
+		discoveries = append(discoveries, d)
+	}
+	for i := range discoveries {
+		discoveries[i].setDefaults()
+	}
+	return discoveries, nil
+}
+
+func (d Discovery) mapping(s *corev1.Service) Mapping {
+	m := Mapping{
+		SourceNamespace:      s.Namespace,
+		SourceName:           s.Name,
+		DestinationNamespace: d.DestinationNamespace,
+		DestinationName:      s.Name,
+	}
+	if m.DestinationNamespace == "" {
+		m.DestinationNamespace = s.Namespace
+	}
+	return m
+}
+
+//RunDiscovery starts a mapping for every source service matching the discovery and keeps watching for services
+//that start or stop matching.
+func RunDiscovery(ctx context.Context, d Discovery, mgr *Manager) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	selector, _ := labels.Parse(d.Selector)
+	runDiscoveryWatchers(ctx, d.SourceNamespaces, func(ns string) *discoveryWatcher {
+		return &discoveryWatcher{
+			description: fmt.Sprintf("selector %q", d.Selector),
+			namespace:   ns,
+			listOptions: metav1.ListOptions{LabelSelector: d.Selector},
+			matches: func(s *corev1.Service) bool {
+				return selector.Matches(labels.Set(s.Labels))
+			},
+			mapping: d.mapping,
+			policy:  d.UnmatchedPolicy,
+			mgr:     mgr,
+			matched: map[string]Mapping{},
+		}
+	})
+	return nil
+}
+
+func runDiscoveryWatchers(ctx context.Context, namespaces []string, newWatcher func(namespace string) *discoveryWatcher) {
+	for _, ns := range namespacesOrAll(namespaces) {
+		go newWatcher(ns).run(ctx)
+	}
+}
+
+//discoveryWatcher starts and stops mappings for the source services of a namespace as they start or stop matching.
+type discoveryWatcher struct {
+	description string
+	namespace   string
+	listOptions metav1.ListOptions
+	matches     func(s *corev1.Service) bool
+	mapping     func(s *corev1.Service) Mapping
+	policy      UnmatchedPolicy
+	mgr         *Manager
+	// matched holds the mappings started by this watcher, keyed by source namespace/name.
+	matched map[string]Mapping
+}
+
+func (dw *discoveryWatcher) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := dw.listAndWatch(ctx); err != nil {
+			logrus.Errorf("error while discovering services with %s: %s", dw.description, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(discoveryRetryPeriod):
+			}
+		}
+	}
+}
+
+func (dw *discoveryWatcher) listAndWatch(ctx context.Context) error {
+	opts := dw.listOptions
+	list, err := dw.mgr.sourceCS.CoreV1().Services(dw.namespace).List(ctx, opts)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i := range list.Items {
+		seen[sourceKey(&list.Items[i])] = true
+		dw.handle(ctx, watch.Added, &list.Items[i])
+	}
+	// services that went away while we were not watching
+	for key, m := range dw.matched {
+		if !seen[key] {
+			dw.unmatch(ctx, key, m)
+		}
+	}
+	opts.ResourceVersion = list.ResourceVersion
+	w, err := dw.mgr.sourceCS.CoreV1().Services(dw.namespace).Watch(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Added, watch.Modified, watch.Deleted:
+			dw.handle(ctx, event.Type, event.Object.(*corev1.Service))
+		case watch.Error:
+			return fmt.Errorf("watch error: %v", event.Object)
+		}
+	}
+	return nil
+}
+
+func (dw *discoveryWatcher) handle(ctx context.Context, eventType watch.EventType, s *corev1.Service) {
+	key := sourceKey(s)
+	old, wasMatched := dw.matched[key]
+	if eventType == watch.Deleted || !dw.matches(s) {
+		if wasMatched {
+			dw.unmatch(ctx, key, old)
+		}
+		return
+	}
+	m := dw.mapping(s)
+	if wasMatched && old.String() != m.String() {
+		// the destination of the service changed
+		dw.unmatch(ctx, key, old)
+	}
+	if err := dw.mgr.Start(ctx, m); err != nil {
+		logrus.Errorf("could not start discovered mapping %s: %s", m, err)
+		return
+	}
+	dw.matched[key] = m
+}
+
+func (dw *discoveryWatcher) unmatch(ctx context.Context, key string, m Mapping) {
+	logrus.Infof("service %s no longer matches %s, applying policy %s", key, dw.description, dw.policy)
+	stopped := dw.mgr.Stop(m)
+	delete(dw.matched, key)
+	if dw.policy == UnmatchedDelete {
+		// a sync in flight would write the destination again
+		<-stopped
+		if err := DeleteService(ctx, m.DestinationNamespace, m.DestinationName, dw.mgr.targetCS); err != nil {
+			logrus.Errorf("error while deleting unmatched service %s: %s", m, err)
+		}
+		if err := DeleteEndpoints(ctx, m.DestinationNamespace, m.DestinationName, dw.mgr.targetCS); err != nil {
+			logrus.Errorf("error while deleting unmatched endpoints %s: %s", m, err)
+		}
+	}
+}
+
+func sourceKey(s *corev1.Service) string {
+	return s.Namespace + "/" + s.Name
+}
@@ -0,0 +1,159 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func discoverySource() *fake.Clientset {
+	return fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+			Labels: map[string]string{
+				"mirror": "true",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port: 80,
+				},
+			},
+		},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	}, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "otherService",
+			Namespace: "foo",
+		},
+	})
+}
+
+func TestRunDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := discoverySource()
+	targetCS := fake.NewSimpleClientset()
+	d := Discovery{Selector: "mirror=true", SourceNamespaces: []string{"foo"}, DestinationNamespace: "bar"}
+	d.setDefaults()
+	if err := RunDiscovery(ctx, d, NewManager("source", sourceCS, targetCS)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "fooService", metav1.GetOptions{}); err != nil {
+		t.Errorf("matching service was not synchronized: %s", err)
+	}
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "otherService", metav1.GetOptions{}); err == nil {
+		t.Error("service not matching the selector was synchronized")
+	}
+
+	s, err := sourceCS.CoreV1().Services("foo").Get(ctx, "fooService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Labels = nil
+	if _, err := sourceCS.CoreV1().Services("foo").Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "fooService", metav1.GetOptions{}); err == nil {
+		t.Error("service that stopped matching was not deleted")
+	}
+	if _, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "fooService", metav1.GetOptions{}); err == nil {
+		t.Error("endpoints of service that stopped matching were not deleted")
+	}
+}
+
+func TestRunDiscoveryKeep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := discoverySource()
+	targetCS := fake.NewSimpleClientset()
+	d := Discovery{Selector: "mirror=true", SourceNamespaces: []string{"foo"}, UnmatchedPolicy: UnmatchedKeep}
+	mgr := NewManager("source", sourceCS, targetCS)
+	if err := RunDiscovery(ctx, d, mgr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	if err := sourceCS.CoreV1().Services("foo").Delete(ctx, "fooService", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	if _, err := targetCS.CoreV1().Services("foo").Get(ctx, "fooService", metav1.GetOptions{}); err != nil {
+		t.Errorf("service should be kept: %s", err)
+	}
+	if mgr.Running(Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "foo", DestinationName: "fooService"}) {
+		t.Error("mapping of deleted service is still running")
+	}
+}
+
+func TestManagerStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := discoverySource()
+	// the start of the mapping hangs until released
+	release := make(chan struct{})
+	sourceCS.PrependReactor("get", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		<-release
+		return false, nil, nil
+	})
+	mgr := NewManager("source", sourceCS, fake.NewSimpleClientset())
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "fooService"}
+	started := make(chan error)
+	go func() {
+		started <- mgr.Start(ctx, m)
+	}()
+	time.Sleep(sleepLength)
+	running := make(chan bool)
+	go func() {
+		running <- mgr.Running(m)
+	}()
+	select {
+	case r := <-running:
+		if !r {
+			t.Error("expected the starting mapping to be running")
+		}
+	case <-time.After(sleepLength):
+		t.Fatal("Running is blocked by the start of the mapping")
+	}
+	stopped := mgr.Stop(m)
+	select {
+	case <-stopped:
+		t.Error("expected the mapping to stop once its start returned")
+	default:
+	}
+	close(release)
+	<-started
+	select {
+	case <-stopped:
+	case <-time.After(sleepLength):
+		t.Error("the stopped mapping did not stop")
+	}
+	if mgr.Running(m) {
+		t.Error("expected the stopped mapping not to be running")
+	}
+	select {
+	case <-mgr.Stop(m):
+	default:
+		t.Error("expected a mapping that is not running to be stopped")
+	}
+}
+
+func TestRunDiscoveryInvalid(t *testing.T) {
+	d := Discovery{Selector: "mirror=true", UnmatchedPolicy: "explode"}
+	if err := RunDiscovery(context.Background(), d, NewManager("source", fake.NewSimpleClientset(), fake.NewSimpleClientset())); err == nil {
+		t.Error("discovery with unknown unmatched-policy should not start")
+	}
+}
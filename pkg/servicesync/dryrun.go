@@ -0,0 +1,97 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+//dryRun is set if writes to the destination clusters are dry-runs.
+var dryRun bool
+
+//ConfigureDryRun makes all writes to the destination clusters server-side dry-runs if dry-run is set. The objects the
+//destinations would store are logged along with the changes, and are served to later reads so that the syncs continue
+//from them. Leader election keeps using the destination cluster as configured, see leaderElectionConfig.
+func ConfigureDryRun(v *viper.Viper) {
+	if !v.GetBool("dry-run") {
+		return
+	}
+	logrus.Warn("dry-run: no changes are written to the destination clusters")
+	dryRun = true
+	config := v.Get("destination-kube-config").(*rest.Config)
+	v.Set("leader-election-kube-config", config)
+	v.Set("destination-kube-config", withDryRun(config))
+}
+
+//withDryRun returns a copy of the config of a destination cluster whose writes are dry-runs if dry-run is configured.
+func withDryRun(config *rest.Config) *rest.Config {
+	if !dryRun {
+		return config
+	}
+	t := newRecordingTransport(true)
+	t.log = true
+	return recordingConfig(config, t)
+}
+
+//Diff prints a unified diff between the current destination objects of the configured mappings and the objects
+//servicesync would write to out. The writes are server-side dry-runs, so the destination is not changed. It returns
+//whether there are any differences. A mapping that cannot be synced is logged and reported as an error once all
+//mappings were diffed.
+func Diff(ctx context.Context, v *viper.Viper, out io.Writer) (bool, error) {
+	ConfigureResolver(v)
+	sourceCS, err := kubernetes.NewForConfig(v.Get("source-kube-config").(*rest.Config))
+	if err != nil {
+		return false, err
+	}
+	mappings, err := listMappings(ctx, v, sourceCS)
+	if err != nil {
+		return false, err
+	}
+	// a transport per destination cluster, as the objects are recorded by path
+	transports := map[string]*recordingTransport{}
+	var clusters []string
+	failed := 0
+	for _, m := range mappings {
+		ds, err := destinations(m, v.Get("destination-kube-config").(*rest.Config))
+		if err != nil {
+			logrus.Errorf("could not diff mapping %s: %s", m, err)
+			failed++
+			continue
+		}
+		for _, d := range ds {
+			t, ok := transports[d.mapping.DestinationCluster]
+			if !ok {
+				t = newRecordingTransport(true)
+				t.cluster = d.mapping.DestinationCluster
+				transports[t.cluster] = t
+				clusters = append(clusters, t.cluster)
+			}
+			targetCS, err := kubernetes.NewForConfig(recordingConfig(d.config, t))
+			if err == nil {
+				err = syncMapping(ctx, d.mapping, sourceCS, targetCS)
+			}
+			if err != nil {
+				logrus.Errorf("could not diff mapping %s: %s", d.mapping, err)
+				failed++
+			}
+		}
+	}
+	changed := false
+	for _, c := range clusters {
+		clusterChanged, err := transports[c].diff(out)
+		changed = changed || clusterChanged
+		if err != nil {
+			return changed, err
+		}
+	}
+	if failed > 0 {
+		return changed, fmt.Errorf("%d mappings could not be diffed", failed)
+	}
+	return changed, nil
+}
@@ -0,0 +1,202 @@
+package servicesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+//dryRunServer is an API server with the given services and no endpoint slices in namespace bar that answers dry-run
+//writes by echoing the object and fails the test on any other write.
+func dryRunServer(t *testing.T, services ...*corev1.Service) (*httptest.Server, func() []string) {
+	var lock sync.Mutex
+	var writes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			for _, s := range services {
+				if r.URL.Path == "/api/v1/namespaces/bar/services/"+s.Name {
+					json.NewEncoder(w).Encode(s)
+					return
+				}
+			}
+			if r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/bar/endpointslices" {
+				json.NewEncoder(w).Encode(&discoveryv1.EndpointSliceList{TypeMeta: metav1.TypeMeta{Kind: "EndpointSliceList", APIVersion: "discovery.k8s.io/v1"}})
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+			return
+		}
+		if r.URL.Query().Get("dryRun") != metav1.DryRunAll {
+			t.Errorf("%s %s was not a dry-run", r.Method, r.URL.Path)
+		}
+		lock.Lock()
+		writes = append(writes, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			w.Write(body)
+		case http.MethodDelete:
+			json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusSuccess})
+		default:
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return writes
+	}
+}
+
+func TestDryRunTransport(t *testing.T) {
+	ctx := context.Background()
+	server, writes := dryRunServer(t)
+	cs, err := kubernetes.NewForConfig(recordingConfig(&rest.Config{Host: server.URL}, newRecordingTransport(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "barService", Namespace: "bar"}, Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}}}
+	if _, err := cs.CoreV1().Services("bar").Create(ctx, service, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CoreV1().Services("bar").Create(ctx, service, metav1.CreateOptions{}); !k8serror.IsAlreadyExists(err) {
+		t.Errorf("expected the dry-run service to exist, got %v", err)
+	}
+	s, err := cs.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Spec.Ports[0].Port = 81
+	if _, err := cs.CoreV1().Services("bar").Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s, err = cs.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil || s.Spec.Ports[0].Port != 81 {
+		t.Errorf("expected the updated dry-run service, got %v, %v", s, err)
+	}
+	if err := cs.CoreV1().Services("bar").Delete(ctx, "barService", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{}); !k8serror.IsNotFound(err) {
+		t.Errorf("expected the dry-run service to be deleted, got %v", err)
+	}
+	// the update of a service that only exists in the dry-run is validated as a creation
+	expected := []string{"POST /api/v1/namespaces/bar/services", "POST /api/v1/namespaces/bar/services"}
+	if w := writes(); strings.Join(w, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected writes %v, got %v", expected, w)
+	}
+}
+
+func TestDryRunTransportUnsyncedResources(t *testing.T) {
+	ctx := context.Background()
+	server, writes := dryRunServer(t)
+	transport := newRecordingTransport(true)
+	cs, err := kubernetes.NewForConfig(recordingConfig(&rest.Config{Host: server.URL}, transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &corev1.Event{ObjectMeta: metav1.ObjectMeta{Name: "barService.1", Namespace: "bar"}}
+	if _, err := cs.CoreV1().Events("bar").Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CoreV1().Events("bar").Get(ctx, "barService.1", metav1.GetOptions{}); !k8serror.IsNotFound(err) {
+		t.Errorf("expected the dry-run event not to be served, got %v", err)
+	}
+	transport.lock.Lock()
+	recorded := len(transport.objects)
+	transport.lock.Unlock()
+	if recorded != 0 {
+		t.Errorf("expected the event not to be recorded, got %d objects", recorded)
+	}
+	if w := writes(); len(w) != 1 {
+		t.Errorf("expected the event to be written as a dry-run, got %v", w)
+	}
+}
+
+func TestDryRunEndpointSlices(t *testing.T) {
+	ctx := context.Background()
+	m := Mapping{SourceCluster: "source", SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", EndpointSlices: true}
+	service := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "barService", Namespace: "bar"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	setOwnership(&service.ObjectMeta, m)
+	server, writes := dryRunServer(t, service)
+	cs, err := kubernetes.NewForConfig(recordingConfig(&rest.Config{Host: server.URL}, newRecordingTransport(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []*discoveryv1.EndpointSlice{sourceSlice("fooService-abc", "fooService", "10.0.0.1")}
+	// the second sync finds the slice of the first one in the list instead of creating it again
+	for i := 0; i < 2; i++ {
+		if err := UpdateEndpointSlices(ctx, sources, m, cs); err != nil {
+			t.Fatalf("sync %d: %v", i, err)
+		}
+	}
+	if w := writes(); len(w) != 1 || !strings.HasPrefix(w[0], "POST ") {
+		t.Errorf("expected a single creation, got %v", w)
+	}
+	slices, err := cs.DiscoveryV1().EndpointSlices("bar").List(ctx, metav1.ListOptions{LabelSelector: managedSliceSelector("barService").String()})
+	if err != nil || len(slices.Items) != 1 {
+		t.Errorf("expected the dry-run slice in the list, got %v, %v", slices, err)
+	}
+}
+
+func TestDryRunTransportDiff(t *testing.T) {
+	ctx := context.Background()
+	existing := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "barService", Namespace: "bar", ResourceVersion: "1"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.0.0.1", Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	server, _ := dryRunServer(t, existing)
+	transport := newRecordingTransport(true)
+	cs, err := kubernetes.NewForConfig(recordingConfig(&rest.Config{Host: server.URL}, transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if changed, err := transport.diff(&out); err != nil || changed {
+		t.Errorf("expected no changes before any write, got %v, %v", changed, err)
+	}
+	s := existing.DeepCopy()
+	s.Spec.Ports[0].Port = 81
+	if _, err := cs.CoreV1().Services("bar").Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CoreV1().Services("bar").Create(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "bazService", Namespace: "bar"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := transport.diff(&out)
+	if err != nil || !changed {
+		t.Fatalf("expected changes, got %v, %v", changed, err)
+	}
+	d := out.String()
+	for _, want := range []string{"--- current/bar/services/barService", "+++ servicesync/bar/services/barService", "-  - port: 80", "+  - port: 81", "+++ servicesync/bar/services/bazService", "+  name: bazService"} {
+		if !strings.Contains(d, want) {
+			t.Errorf("diff does not contain %q:\n%s", want, d)
+		}
+	}
+	if strings.Contains(d, "resourceVersion") {
+		t.Errorf("diff contains fields maintained by the cluster:\n%s", d)
+	}
+}
@@ -2,98 +2,204 @@ package servicesync
 
 import (
 	"context"
-	"net/http"
 
 	"github.com/sirupsen/logrus"
 
 	corev1 "k8s.io/api/core/v1"
 	k8serror "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 //EnsureEndpoints ensures that getting the endpoints will not lead to a 404. An empty endpoints is created if not found.
-func EnsureEndpoints(ctx context.Context, namespace, targetName string, cs kubernetes.Interface) error {
-	_, err := cs.CoreV1().Endpoints(namespace).Get(ctx, targetName, metav1.GetOptions{})
+//Existing endpoints that are not managed by the mapping result in a ConflictError.
+func EnsureEndpoints(ctx context.Context, m Mapping, cs kubernetes.Interface) error {
+	target, err := cs.CoreV1().Endpoints(m.DestinationNamespace).Get(ctx, m.DestinationName, metav1.GetOptions{})
+	if err == nil {
+		return checkEndpointsOwnership(target, m, cs)
+	}
+	if !k8serror.IsNotFound(err) {
+		logrus.Errorf("Unexpected error while ensuring endpoints: %s", err)
+		return err
+	}
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m.DestinationName,
+			Namespace: m.DestinationNamespace,
+		},
+	}
+	setOwnership(&endpoints.ObjectMeta, m)
+	_, err = cs.CoreV1().Endpoints(m.DestinationNamespace).Create(ctx, endpoints, metav1.CreateOptions{})
 	if err != nil {
-		if err.(*k8serror.StatusError).Status().Code == http.StatusNotFound {
-			_, err = cs.CoreV1().Endpoints(namespace).Create(ctx, &corev1.Endpoints{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      targetName,
-					Namespace: namespace,
-				},
-			}, metav1.CreateOptions{})
-			if err != nil {
-				logrus.Errorf("Unexpected error while creating endpoints: %s", err)
-				return err
-			}
-		} else {
-			logrus.Errorf("Unexpected error while ensuring endpoints: %s", err)
-			return err
-		}
+		logrus.Errorf("Unexpected error while creating endpoints: %s", err)
+		return err
 	}
 	return nil
 }
 
-//SyncEndpoints does a one time sync between the source and target endpoints resource
-func GetAndUpdateEndpoints(ctx context.Context, sourceNamespace, sourceName, targetNamespace, targetName string, sourceCS, targetCS kubernetes.Interface) error {
-	s, err := sourceCS.CoreV1().Endpoints(sourceNamespace).Get(ctx, sourceName, metav1.GetOptions{})
+//GetAndUpdateEndpoints does a one time sync between the source and target endpoints resource
+func GetAndUpdateEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	s, err := sourceCS.CoreV1().Endpoints(m.SourceNamespace).Get(ctx, m.SourceName, metav1.GetOptions{})
 	if err != nil {
 		logrus.Errorf("error while getting endpoints definition from source: %s", err)
 		return err
 	}
-	s = transformEndpoints(s, targetNamespace, targetName)
-	_, err = targetCS.CoreV1().Endpoints(targetNamespace).Update(ctx, s, metav1.UpdateOptions{})
+	return UpdateEndpoints(ctx, s, m, targetCS)
+}
+
+//SyncEndpoints keeps the target endpoints in sync with the source endpoints until ctx is done. Recreated source
+//endpoints are synced again and deleted ones are handled according to the OnDelete policy of the mapping. It returns
+//once the initial state of the source endpoints has been observed. The returned channel is closed once ctx is done and
+//the sync in flight, if any, has completed.
+func SyncEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	wctx := watchContext(ctx, m)
+	lw := &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			return sourceCS.CoreV1().Endpoints(m.SourceNamespace).List(wctx, withName(o, m.SourceName))
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			return sourceCS.CoreV1().Endpoints(m.SourceNamespace).Watch(wctx, withName(o, m.SourceName))
+		},
+	}
+	// added is true until the source has been synced and again once it was deleted. A source that is added again may
+	// be synced to a destination that was deleted along with its previous incarnation.
+	added := true
+	s := newSourceSyncer("endpoints", m, lw, &corev1.Endpoints{}, func(ctx context.Context, obj interface{}) error {
+		if added {
+			if err := EnsureEndpoints(ctx, m, targetCS); err != nil {
+				return err
+			}
+		}
+		if err := UpdateEndpoints(ctx, obj.(*corev1.Endpoints), m, targetCS); err != nil {
+			// the target may have been deleted along with a recreated target service
+			added = k8serror.IsNotFound(err)
+			return err
+		}
+		added = false
+		return nil
+	}, func(ctx context.Context) error {
+		added = true
+		switch m.OnDelete {
+		case DeletionDelete:
+			logrus.Infof("source endpoints of mapping %s were deleted, deleting target endpoints", m)
+			return DeleteEndpoints(ctx, m.DestinationNamespace, m.DestinationName, targetCS)
+		case DeletionBlank:
+			logrus.Infof("source endpoints of mapping %s were deleted, removing all target endpoints", m)
+			return UpdateEndpoints(ctx, &corev1.Endpoints{}, m, targetCS)
+		}
+		return nil
+	})
+	done, err := s.run(ctx)
 	if err != nil {
-		logrus.Errorf("error while updating new target endpoints definition: %s", err)
-		return err
+		logrus.Errorf("error while establishing a watch connection from source: %s", err)
+		return nil, err
 	}
-	return nil
+	return done, nil
 }
 
-func SyncEndpoints(ctx context.Context, sourceNamespace, sourceName, targetNamespace, targetName string, sourceCS, targetCS kubernetes.Interface) error {
-	w, err := sourceCS.CoreV1().Endpoints(sourceNamespace).Watch(ctx, metav1.ListOptions{})
+//UpdateEndpoints updates the target endpoints from the source endpoints. With a local selector the source endpoints are
+//merged with the local pods.
+func UpdateEndpoints(ctx context.Context, source *corev1.Endpoints, m Mapping, targetCS kubernetes.Interface) error {
+	if m.LocalSelector != "" {
+		return updateLocalEndpoints(ctx, source, m, targetCS)
+	}
+	return writeEndpoints(ctx, source, m, targetCS)
+}
+
+//writeEndpoints replaces the addresses of the target endpoints with the transformed addresses of endpoints.
+func writeEndpoints(ctx context.Context, source *corev1.Endpoints, m Mapping, targetCS kubernetes.Interface) error {
+	target, err := targetCS.CoreV1().Endpoints(m.DestinationNamespace).Get(ctx, m.DestinationName, metav1.GetOptions{})
 	if err != nil {
-		logrus.Errorf("error while establishing a watch connection from source: %s", err)
+		logrus.Errorf("error while getting existing target endpoints: %s", err)
+		recordSync(m, "endpoints", err)
 		return err
 	}
-	wc := w.ResultChan()
-	go func() {
-		for {
-			event := <-wc
-			if event.Type == "MODIFIED" {
-				if endpoints := event.Object.(*corev1.Endpoints); endpoints.Name == sourceName {
-					endpoints = transformEndpoints(endpoints, targetNamespace, targetName)
-					_, err := targetCS.CoreV1().Endpoints(targetNamespace).Update(ctx, endpoints, metav1.UpdateOptions{})
-					if err != nil {
-						logrus.Errorf("error while updating target endpoints: %s", err)
-					}
-				}
-			}
-		}
-	}()
+	if err := checkEndpointsOwnership(target, m, targetCS); err != nil {
+		recordSync(m, "endpoints", err)
+		return err
+	}
+	endpoints := transformEndpoints(source, m)
+	setOwnership(&endpoints.ObjectMeta, m)
+	_, err = targetCS.CoreV1().Endpoints(m.DestinationNamespace).Update(ctx, endpoints, metav1.UpdateOptions{})
+	recordSync(m, "endpoints", err)
+	if err != nil {
+		logrus.Errorf("error while updating target endpoints: %s", err)
+		return err
+	}
+	ready, notReady := 0, 0
+	for _, s := range endpoints.Subsets {
+		ready += len(s.Addresses)
+		notReady += len(s.NotReadyAddresses)
+	}
+	recordEndpointAddresses(m, ready, notReady)
 	return nil
 }
 
-func transformEndpoints(s *corev1.Endpoints, namespace, name string) *corev1.Endpoints {
+//transformEndpoints copies the addresses and ports of the source endpoints to the destination of the mapping. Addresses
+//of IP families the mapping does not allow are dropped, and so are subsets that are left without addresses. Hostnames
+//are only kept in headless mode, where they give every address its own DNS name.
+func transformEndpoints(s *corev1.Endpoints, m Mapping) *corev1.Endpoints {
+	address := func(a corev1.EndpointAddress) corev1.EndpointAddress {
+		if m.Headless {
+			return corev1.EndpointAddress{IP: a.IP, Hostname: a.Hostname}
+		}
+		return corev1.EndpointAddress{IP: a.IP}
+	}
 	var newSubsets []corev1.EndpointSubset
 	for _, v := range s.Subsets {
 		var newSubset corev1.EndpointSubset
 		for _, a := range v.Addresses {
-			newSubset.Addresses = append(newSubset.Addresses, corev1.EndpointAddress{IP: a.IP})
+			if allowsAddress(m.IPFamilies, a.IP) {
+				newSubset.Addresses = append(newSubset.Addresses, address(a))
+			}
 		}
 		for _, a := range v.NotReadyAddresses {
-			newSubset.NotReadyAddresses = append(newSubset.NotReadyAddresses, corev1.EndpointAddress{IP: a.IP})
+			if allowsAddress(m.IPFamilies, a.IP) {
+				newSubset.NotReadyAddresses = append(newSubset.NotReadyAddresses, address(a))
+			}
+		}
+		if len(newSubset.Addresses)+len(newSubset.NotReadyAddresses) == 0 && len(v.Addresses)+len(v.NotReadyAddresses) > 0 {
+			continue
 		}
 		newSubset.Ports = v.Ports
 		newSubsets = append(newSubsets, newSubset)
 	}
 	transformed := corev1.Endpoints{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
+			Name:      m.DestinationName,
+			Namespace: m.DestinationNamespace,
 		},
 		Subsets: newSubsets,
 	}
 	return &transformed
 }
+
+func checkEndpointsOwnership(target *corev1.Endpoints, m Mapping, cs kubernetes.Interface) error {
+	err := checkOwnership("endpoints", target, m)
+	if conflict, ok := err.(*ConflictError); ok {
+		recordConflict(cs, target, conflict)
+	}
+	return err
+}
+
+//DeleteEndpoints deletes the target endpoints if they are managed by servicesync. Endpoints that do not exist are not
+//an error.
+func DeleteEndpoints(ctx context.Context, namespace, targetName string, cs kubernetes.Interface) error {
+	target, err := cs.CoreV1().Endpoints(namespace).Get(ctx, targetName, metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !isManaged(target) {
+		return &ConflictError{Kind: "endpoints", Namespace: namespace, Name: targetName, Reason: "is not managed by servicesync"}
+	}
+	err = cs.CoreV1().Endpoints(namespace).Delete(ctx, targetName, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(target.UID))})
+	if err != nil && !k8serror.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
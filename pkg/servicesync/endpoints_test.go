@@ -18,7 +18,7 @@ func TestEnsureEndpointsNotFound(t *testing.T) {
 	targetName := "fooService"
 	cs := fake.NewSimpleClientset()
 	ctx := context.Background()
-	err := EnsureEndpoints(ctx, namespace, targetName, cs)
+	err := EnsureEndpoints(ctx, Mapping{DestinationNamespace: namespace, DestinationName: targetName}, cs)
 	if err != nil {
 		t.Error(err)
 	}
@@ -95,7 +95,7 @@ func TestGetAndUpdateEndpoints(t *testing.T) {
 			Namespace: targetNamespace,
 		},
 	})
-	err := GetAndUpdateEndpoints(ctx, sourceNamespace, sourceName, targetNamespace, targetName, sourceCS, targetCS)
+	err := GetAndUpdateEndpoints(ctx, Mapping{SourceNamespace: sourceNamespace, SourceName: sourceName, DestinationNamespace: targetNamespace, DestinationName: targetName, Adopt: true}, sourceCS, targetCS)
 	if err != nil {
 		t.Error(err)
 	}
@@ -183,7 +183,7 @@ func TestSyncEndpoints(t *testing.T) {
 			Namespace: targetNamespace,
 		},
 	})
-	if err := SyncEndpoints(ctx, sourceNamespace, sourceName, targetNamespace, targetName, sourceCS, targetCS); err != nil {
+	if _, err := SyncEndpoints(ctx, Mapping{SourceNamespace: sourceNamespace, SourceName: sourceName, DestinationNamespace: targetNamespace, DestinationName: targetName, Adopt: true}, sourceCS, targetCS); err != nil {
 		t.Error(err)
 	}
 	patch := []byte(`{
@@ -220,3 +220,63 @@ func TestSyncEndpoints(t *testing.T) {
 		}
 	}
 }
+
+func TestSyncEndpointsOnDelete(t *testing.T) {
+	source := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{
+					{
+						IP: "1.2.3.4",
+					},
+				},
+			},
+		},
+	}
+	for _, policy := range []DeletionPolicy{DeletionKeep, DeletionDelete, DeletionBlank} {
+		t.Run(string(policy), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sourceCS := fake.NewSimpleClientset(source.DeepCopy())
+			targetCS := fake.NewSimpleClientset()
+			m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", OnDelete: policy}
+			if _, err := SyncEndpoints(ctx, m, sourceCS, targetCS); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(sleepLength)
+			if err := sourceCS.CoreV1().Endpoints("foo").Delete(ctx, "fooService", metav1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(sleepLength)
+			out, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "barService", metav1.GetOptions{})
+			switch policy {
+			case DeletionKeep:
+				if err != nil || len(out.Subsets) != 1 {
+					t.Errorf("target endpoints were not kept: %v %s", out, err)
+				}
+			case DeletionDelete:
+				if err == nil {
+					t.Error("target endpoints were not deleted")
+				}
+			case DeletionBlank:
+				if err != nil || len(out.Subsets) != 0 {
+					t.Errorf("target endpoints were not blanked: %v %s", out, err)
+				}
+			}
+
+			// a recreated source is synced again
+			if _, err := sourceCS.CoreV1().Endpoints("foo").Create(ctx, source.DeepCopy(), metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(sleepLength)
+			out, err = targetCS.CoreV1().Endpoints("bar").Get(ctx, "barService", metav1.GetOptions{})
+			if err != nil || len(out.Subsets) != 1 {
+				t.Errorf("recreated source endpoints were not synced: %v %s", out, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	//endpointSliceManagedBy is the value of the standard managed-by label of destination EndpointSlices. It keeps the
+	//EndpointSlice controllers of the destination cluster from touching them.
+	endpointSliceManagedBy = "servicesync.io"
+	//maxEndpointsPerSlice matches the default of the EndpointSlice controller.
+	maxEndpointsPerSlice = 100
+)
+
+//serviceNameSelector selects the EndpointSlices of the named service.
+func serviceNameSelector(name string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: name})
+}
+
+//managedSliceSelector selects the EndpointSlices servicesync manages for the named destination service.
+func managedSliceSelector(name string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: name, ManagedByLabel: managedByValue})
+}
+
+//GetAndUpdateEndpointSlices does a one time sync between the EndpointSlices of the source service and the
+//EndpointSlices of the target service.
+func GetAndUpdateEndpointSlices(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	list, err := sourceCS.DiscoveryV1().EndpointSlices(m.SourceNamespace).List(ctx, metav1.ListOptions{LabelSelector: serviceNameSelector(m.SourceName).String()})
+	if err != nil {
+		logrus.Errorf("error while getting endpoint slices from source: %s", err)
+		return err
+	}
+	sources := make([]*discoveryv1.EndpointSlice, 0, len(list.Items))
+	for i := range list.Items {
+		sources = append(sources, &list.Items[i])
+	}
+	return UpdateEndpointSlices(ctx, sources, m, targetCS)
+}
+
+//SyncEndpointSlices keeps the target EndpointSlices in sync with all EndpointSlices of the source service until ctx is
+//done. Once the source service has no EndpointSlices left, they are handled according to the OnDelete policy of the
+//mapping. The returned channel is closed once ctx is done and the sync in flight, if any, has completed.
+func SyncEndpointSlices(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	selector := serviceNameSelector(m.SourceName)
+	wctx := watchContext(ctx, m)
+	lw := &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			o.LabelSelector = selector.String()
+			return sourceCS.DiscoveryV1().EndpointSlices(m.SourceNamespace).List(wctx, o)
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			o.LabelSelector = selector.String()
+			return sourceCS.DiscoveryV1().EndpointSlices(m.SourceNamespace).Watch(wctx, o)
+		},
+	}
+	s := newAggregateSourceSyncer("endpointslices", m, selector, lw, &discoveryv1.EndpointSlice{}, func(ctx context.Context, obj interface{}) error {
+		var sources []*discoveryv1.EndpointSlice
+		for _, o := range obj.([]interface{}) {
+			sources = append(sources, o.(*discoveryv1.EndpointSlice))
+		}
+		return UpdateEndpointSlices(ctx, sources, m, targetCS)
+	}, func(ctx context.Context) error {
+		switch m.OnDelete {
+		case DeletionDelete, DeletionBlank:
+			logrus.Infof("source endpoint slices of mapping %s were deleted, deleting target endpoint slices", m)
+			return DeleteEndpointSlices(ctx, m.DestinationNamespace, m.DestinationName, targetCS)
+		}
+		return nil
+	})
+	done, err := s.run(ctx)
+	if err != nil {
+		logrus.Errorf("error while establishing a watch connection from source: %s", err)
+		return nil, err
+	}
+	return done, nil
+}
+
+//UpdateEndpointSlices replaces the managed EndpointSlices of the target service with the endpoints of the source
+//EndpointSlices. Stale target EndpointSlices are deleted after the new ones were written.
+func UpdateEndpointSlices(ctx context.Context, sources []*discoveryv1.EndpointSlice, m Mapping, targetCS kubernetes.Interface) error {
+	err := updateEndpointSlices(ctx, sources, m, targetCS)
+	recordSync(m, "endpointslices", err)
+	return err
+}
+
+func updateEndpointSlices(ctx context.Context, sources []*discoveryv1.EndpointSlice, m Mapping, targetCS kubernetes.Interface) error {
+	service, err := targetCS.CoreV1().Services(m.DestinationNamespace).Get(ctx, m.DestinationName, metav1.GetOptions{})
+	if err != nil {
+		logrus.Errorf("error while getting existing target service: %s", err)
+		return err
+	}
+	// the slices belong to the target service
+	if err := checkServiceOwnership(service, m, targetCS); err != nil {
+		return err
+	}
+	existing, err := targetCS.DiscoveryV1().EndpointSlices(m.DestinationNamespace).List(ctx, metav1.ListOptions{LabelSelector: managedSliceSelector(m.DestinationName).String()})
+	if err != nil {
+		logrus.Errorf("error while listing existing target endpoint slices: %s", err)
+		return err
+	}
+	current := map[string]*discoveryv1.EndpointSlice{}
+	for i := range existing.Items {
+		current[existing.Items[i].Name] = &existing.Items[i]
+	}
+
+	ready, notReady := 0, 0
+	for _, slice := range transformEndpointSlices(sources, service, m) {
+		setOwnership(&slice.ObjectMeta, m)
+		r, n := countSliceEndpoints(slice)
+		ready, notReady = ready+r, notReady+n
+		old, ok := current[slice.Name]
+		delete(current, slice.Name)
+		if !ok {
+			_, err = targetCS.DiscoveryV1().EndpointSlices(m.DestinationNamespace).Create(ctx, slice, metav1.CreateOptions{})
+		} else if !equalEndpointSlices(old, slice) {
+			slice.ResourceVersion = old.ResourceVersion
+			_, err = targetCS.DiscoveryV1().EndpointSlices(m.DestinationNamespace).Update(ctx, slice, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			logrus.Errorf("error while writing target endpoint slice %s: %s", slice.Name, err)
+			return err
+		}
+	}
+	for name := range current {
+		err = targetCS.DiscoveryV1().EndpointSlices(m.DestinationNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !k8serror.IsNotFound(err) {
+			logrus.Errorf("error while deleting stale target endpoint slice %s: %s", name, err)
+			return err
+		}
+	}
+	recordEndpointAddresses(m, ready, notReady)
+	return nil
+}
+
+//DeleteEndpointSlices deletes the EndpointSlices servicesync manages for the target service.
+func DeleteEndpointSlices(ctx context.Context, namespace, targetName string, cs kubernetes.Interface) error {
+	existing, err := cs.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{LabelSelector: managedSliceSelector(targetName).String()})
+	if err != nil {
+		return err
+	}
+	for _, slice := range existing.Items {
+		err = cs.DiscoveryV1().EndpointSlices(namespace).Delete(ctx, slice.Name, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(slice.UID))})
+		if err != nil && !k8serror.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//transformEndpointSlices aggregates the endpoints of the source slices and splits them into target slices of the
+//target service. Endpoints are grouped by address type and ports, the same way the EndpointSlice controller does, so
+//IPv4 and IPv6 addresses end up in separate slices. Slices of IP families the mapping does not allow are dropped.
+//Conditions are kept while references to source pods, nodes and zones are dropped. Hostnames are only kept in headless
+//mode.
+func transformEndpointSlices(sources []*discoveryv1.EndpointSlice, service *corev1.Service, m Mapping) []*discoveryv1.EndpointSlice {
+	type group struct {
+		addressType discoveryv1.AddressType
+		ports       []discoveryv1.EndpointPort
+		endpoints   map[string]discoveryv1.Endpoint
+	}
+	groups := map[string]*group{}
+	for _, source := range sources {
+		if source.AddressType != discoveryv1.AddressTypeFQDN && !allowsFamily(m.IPFamilies, corev1.IPFamily(source.AddressType)) {
+			continue
+		}
+		key := string(source.AddressType) + "/" + portsKey(source.Ports)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{addressType: source.AddressType, ports: source.Ports, endpoints: map[string]discoveryv1.Endpoint{}}
+			groups[key] = g
+		}
+		for _, e := range source.Endpoints {
+			if !matchesAddressType(source.AddressType, e.Addresses) {
+				logrus.Warnf("skipping endpoint %v of source endpoint slice %s/%s that does not match its address type %s", e.Addresses, source.Namespace, source.Name, source.AddressType)
+				continue
+			}
+			endpoint := discoveryv1.Endpoint{
+				Addresses: e.Addresses,
+				Conditions: discoveryv1.EndpointConditions{
+					Ready:       e.Conditions.Ready,
+					Serving:     e.Conditions.Serving,
+					Terminating: e.Conditions.Terminating,
+				},
+			}
+			if m.Headless {
+				endpoint.Hostname = e.Hostname
+			}
+			// an endpoint may show up in two slices while it moves between them
+			g.endpoints[strings.Join(e.Addresses, ",")] = endpoint
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var slices []*discoveryv1.EndpointSlice
+	for _, key := range keys {
+		g := groups[key]
+		addresses := make([]string, 0, len(g.endpoints))
+		for address := range g.endpoints {
+			addresses = append(addresses, address)
+		}
+		sort.Strings(addresses)
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		for i := 0; i < len(addresses); i += maxEndpointsPerSlice {
+			end := i + maxEndpointsPerSlice
+			if end > len(addresses) {
+				end = len(addresses)
+			}
+			slice := &discoveryv1.EndpointSlice{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("%s-%x-%d", service.Name, h.Sum32(), i/maxEndpointsPerSlice),
+					Namespace: service.Namespace,
+					Labels: map[string]string{
+						discoveryv1.LabelServiceName: service.Name,
+						discoveryv1.LabelManagedBy:   endpointSliceManagedBy,
+					},
+					OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(service, corev1.SchemeGroupVersion.WithKind("Service"))},
+				},
+				AddressType: g.addressType,
+				Ports:       g.ports,
+			}
+			for _, address := range addresses[i:end] {
+				slice.Endpoints = append(slice.Endpoints, g.endpoints[address])
+			}
+			if m.Headless {
+				// keeps kube-proxy from programming rules for the slice, like it does for the slices of any headless service
+				slice.Labels[corev1.IsHeadlessService] = ""
+			}
+			slices = append(slices, slice)
+		}
+	}
+	return slices
+}
+
+//matchesAddressType returns whether all addresses are of the IP family of an IPv4 or IPv6 address type.
+func matchesAddressType(addressType discoveryv1.AddressType, addresses []string) bool {
+	if addressType == discoveryv1.AddressTypeFQDN {
+		return true
+	}
+	for _, a := range addresses {
+		if ipFamilyOf(a) != corev1.IPFamily(addressType) {
+			return false
+		}
+	}
+	return true
+}
+
+//portsKey identifies a list of EndpointSlice ports.
+func portsKey(ports []discoveryv1.EndpointPort) string {
+	var parts []string
+	for _, p := range ports {
+		part := ""
+		if p.Name != nil {
+			part += *p.Name
+		}
+		if p.Protocol != nil {
+			part += "/" + string(*p.Protocol)
+		}
+		if p.Port != nil {
+			part += fmt.Sprintf(":%d", *p.Port)
+		}
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+//countSliceEndpoints counts the ready and not ready endpoints of a slice. An unknown readiness counts as ready.
+func countSliceEndpoints(slice *discoveryv1.EndpointSlice) (int, int) {
+	ready, notReady := 0, 0
+	for _, e := range slice.Endpoints {
+		if e.Conditions.Ready == nil || *e.Conditions.Ready {
+			ready += len(e.Addresses)
+		} else {
+			notReady += len(e.Addresses)
+		}
+	}
+	return ready, notReady
+}
+
+func equalEndpointSlices(a, b *discoveryv1.EndpointSlice) bool {
+	return a.AddressType == b.AddressType &&
+		reflect.DeepEqual(a.Endpoints, b.Endpoints) &&
+		reflect.DeepEqual(a.Ports, b.Ports) &&
+		reflect.DeepEqual(a.Labels, b.Labels) &&
+		reflect.DeepEqual(a.Annotations, b.Annotations) &&
+		reflect.DeepEqual(a.OwnerReferences, b.OwnerReferences)
+}
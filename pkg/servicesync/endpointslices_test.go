@@ -0,0 +1,165 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func sourceSlice(name, service string, addresses ...string) *discoveryv1.EndpointSlice {
+	portName := "http"
+	port := int32(8080)
+	protocol := corev1.ProtocolTCP
+	nodeName := "source-node"
+	hostname := "pod"
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "foo",
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: service,
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{
+				Name:     &portName,
+				Port:     &port,
+				Protocol: &protocol,
+			},
+		},
+	}
+	for _, a := range addresses {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses: []string{a},
+			Conditions: discoveryv1.EndpointConditions{
+				Ready:       boolPtr(true),
+				Serving:     boolPtr(true),
+				Terminating: boolPtr(false),
+			},
+			Hostname: &hostname,
+			NodeName: &nodeName,
+			TargetRef: &corev1.ObjectReference{
+				Kind: "Pod",
+				Name: "source-pod",
+			},
+		})
+	}
+	return slice
+}
+
+func TestTransformEndpointSlices(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "barService",
+			Namespace: "bar",
+			UID:       "service-uid",
+		},
+	}
+	first := sourceSlice("fooService-abc", "fooService", "1.2.3.4", "1.2.3.5")
+	// 1.2.3.5 moves between slices and is terminating
+	second := sourceSlice("fooService-def", "fooService", "1.2.3.5")
+	second.Endpoints[0].Conditions = discoveryv1.EndpointConditions{Ready: boolPtr(false), Serving: boolPtr(true), Terminating: boolPtr(true)}
+
+	slices := transformEndpointSlices([]*discoveryv1.EndpointSlice{first, second}, service, Mapping{})
+	if len(slices) != 1 {
+		t.Fatalf("expected a single slice, got %d", len(slices))
+	}
+	slice := slices[0]
+	if slice.Labels[discoveryv1.LabelServiceName] != "barService" || slice.Labels[discoveryv1.LabelManagedBy] != endpointSliceManagedBy {
+		t.Errorf("unexpected labels %v", slice.Labels)
+	}
+	if len(slice.OwnerReferences) != 1 || slice.OwnerReferences[0].UID != "service-uid" {
+		t.Errorf("slice is not owned by the target service: %v", slice.OwnerReferences)
+	}
+	if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+		t.Errorf("address type not preserved: %s", slice.AddressType)
+	}
+	if len(slice.Ports) != 1 || *slice.Ports[0].Name != "http" || *slice.Ports[0].Port != 8080 {
+		t.Errorf("ports not preserved: %v", slice.Ports)
+	}
+	if len(slice.Endpoints) != 2 {
+		t.Fatalf("expected 2 endpoints, got %v", slice.Endpoints)
+	}
+	for _, e := range slice.Endpoints {
+		if e.Hostname != nil || e.NodeName != nil || e.TargetRef != nil {
+			t.Errorf("source references were not dropped: %v", e)
+		}
+	}
+	if c := slice.Endpoints[1].Conditions; c.Serving == nil || !*c.Serving || c.Terminating == nil || !*c.Terminating {
+		t.Errorf("conditions not preserved: %v", c)
+	}
+}
+
+func TestTransformEndpointSlicesSplit(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "barService", Namespace: "bar"}}
+	var addresses []string
+	for i := 0; i < maxEndpointsPerSlice+1; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	slices := transformEndpointSlices([]*discoveryv1.EndpointSlice{sourceSlice("fooService-abc", "fooService", addresses...)}, service, Mapping{})
+	if len(slices) != 2 || len(slices[0].Endpoints) != maxEndpointsPerSlice || len(slices[1].Endpoints) != 1 {
+		t.Errorf("expected endpoints split into slices of %d", maxEndpointsPerSlice)
+	}
+}
+
+func TestSyncEndpointSlices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", OnDelete: DeletionDelete, EndpointSlices: true}
+	sourceCS := fake.NewSimpleClientset(
+		sourceSlice("fooService-abc", "fooService", "1.2.3.4"),
+		sourceSlice("other-abc", "other", "1.2.3.9"),
+	)
+	targetCS := fake.NewSimpleClientset()
+	if err := EnsureService(ctx, m, targetCS); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SyncEndpointSlices(ctx, m, sourceCS, targetCS); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectAddresses := func(n int) {
+		t.Helper()
+		list, err := targetCS.DiscoveryV1().EndpointSlices("bar").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := 0
+		for _, slice := range list.Items {
+			if !isManaged(&slice) {
+				t.Errorf("slice %s is not managed", slice.Name)
+			}
+			found += len(slice.Endpoints)
+		}
+		if found != n {
+			t.Errorf("expected %d endpoints in the target slices, found %d", n, found)
+		}
+	}
+	expectAddresses(1)
+
+	// a second slice of the source service is aggregated
+	if _, err := sourceCS.DiscoveryV1().EndpointSlices("foo").Create(ctx, sourceSlice("fooService-def", "fooService", "1.2.3.5"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectAddresses(2)
+
+	for _, name := range []string{"fooService-abc", "fooService-def"} {
+		if err := sourceCS.DiscoveryV1().EndpointSlices("foo").Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(sleepLength)
+	expectAddresses(0)
+}
@@ -0,0 +1,40 @@
+package servicesync
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+var (
+	recordersLock sync.Mutex
+	// recorders holds an event recorder per destination client set.
+	recorders = map[kubernetes.Interface]record.EventRecorder{}
+)
+
+//eventRecorder returns the event recorder that writes events to the cluster of cs.
+func eventRecorder(cs kubernetes.Interface) record.EventRecorder {
+	recordersLock.Lock()
+	defer recordersLock.Unlock()
+	if r, ok := recorders[cs]; ok {
+		return r
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+	r := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "servicesync"})
+	recorders[cs] = r
+	return r
+}
+
+//recordConflict logs the conflict and records it as a warning event on the destination object.
+func recordConflict(cs kubernetes.Interface, obj runtime.Object, err *ConflictError) {
+	logrus.Errorf("refusing to update destination: %s", err)
+	eventRecorder(cs).Event(obj, corev1.EventTypeWarning, "Conflict", err.Error())
+}
@@ -0,0 +1,97 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	//ExportAnnotation opts a source service into being synchronized when set to "true".
+	ExportAnnotation = "servicesync.io/export"
+	//ExportAsAnnotation optionally sets the name of the destination service of an exported service.
+	ExportAsAnnotation = "servicesync.io/export-as"
+)
+
+//Export mirrors every source service that is annotated with servicesync.io/export: "true".
+type Export struct {
+	SourceNamespaces []string `mapstructure:"source-namespaces"`
+	//DestinationNamespace defaults to the namespace of the exported service.
+	DestinationNamespace string `mapstructure:"destination-namespace"`
+	//UnexportedPolicy decides what happens to the destination objects when the annotation is removed.
+	UnexportedPolicy UnmatchedPolicy `mapstructure:"unexported-policy"`
+}
+
+func (e *Export) setDefaults() {
+	if e.UnexportedPolicy == "" {
+		e.UnexportedPolicy = UnmatchedDelete
+	}
+}
+
+func (e Export) validate() error {
+	switch e.UnexportedPolicy {
+	case UnmatchedDelete, UnmatchedKeep:
+	default:
+		return fmt.Errorf("export: unknown unexported-policy %q", e.UnexportedPolicy)
+	}
+	return nil
+}
+
+//ExportFromConfig reads the export configuration under the "export" key. nil is returned if exporting is not
+//configured.
+func ExportFromConfig(v *viper.Viper) (*Export, error) {
+	if !v.IsSet("export") {
+		return nil, nil
+	}
+	e := &Export{}
+	if err := v.UnmarshalKey("export", e); err != nil {
+		return nil, fmt.Errorf("could not read export: %s", err)
+	}
+	e.setDefaults()
+	return e, nil
+}
+
+func exported(s *corev1.Service) bool {
+	return s.Annotations[ExportAnnotation] == "true"
+}
+
+func (e Export) mapping(s *corev1.Service) Mapping {
+	m := Mapping{
+		SourceNamespace:      s.Namespace,
+		SourceName:           s.Name,
+		DestinationNamespace: e.DestinationNamespace,
+		DestinationName:      s.Annotations[ExportAsAnnotation],
+	}
+	if m.DestinationNamespace == "" {
+		m.DestinationNamespace = s.Namespace
+	}
+	if m.DestinationName == "" {
+		m.DestinationName = s.Name
+	}
+	return m
+}
+
+//RunExport starts a mapping for every annotated source service and keeps watching for services that are annotated
+//or stop being annotated.
+func RunExport(ctx context.Context, e Export, mgr *Manager) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	runDiscoveryWatchers(ctx, e.SourceNamespaces, func(ns string) *discoveryWatcher {
+		return &discoveryWatcher{
+			description: fmt.Sprintf("annotation %s", ExportAnnotation),
+			namespace:   ns,
+			listOptions: metav1.ListOptions{},
+			matches:     exported,
+			mapping:     e.mapping,
+			policy:      e.UnexportedPolicy,
+			mgr:         mgr,
+			matched:     map[string]Mapping{},
+		}
+	})
+	return nil
+}
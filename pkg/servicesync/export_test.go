@@ -0,0 +1,65 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunExport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+			Annotations: map[string]string{
+				ExportAnnotation:   "true",
+				ExportAsAnnotation: "barService",
+			},
+		},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	}, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "otherService",
+			Namespace: "foo",
+			Annotations: map[string]string{
+				ExportAnnotation: "false",
+			},
+		},
+	})
+	targetCS := fake.NewSimpleClientset()
+	e := Export{SourceNamespaces: []string{"foo"}, DestinationNamespace: "bar"}
+	e.setDefaults()
+	if err := RunExport(ctx, e, NewManager("source", sourceCS, targetCS)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{}); err != nil {
+		t.Errorf("exported service was not synchronized under its export-as name: %s", err)
+	}
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "otherService", metav1.GetOptions{}); err == nil {
+		t.Error("service that is not exported was synchronized")
+	}
+
+	s, err := sourceCS.CoreV1().Services("foo").Get(ctx, "fooService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(s.Annotations, ExportAnnotation)
+	if _, err := sourceCS.CoreV1().Services("foo").Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{}); err == nil {
+		t.Error("service that is no longer exported was not deleted")
+	}
+}
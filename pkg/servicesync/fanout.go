@@ -0,0 +1,88 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+//destination is a destination cluster of a mapping along with the mapping to it.
+type destination struct {
+	mapping Mapping
+	config  *rest.Config
+}
+
+//destinations returns a destination per destination cluster of the mapping, or the default destination cluster if the
+//mapping is not fanned out.
+func destinations(m Mapping, defaultConfig *rest.Config) ([]destination, error) {
+	if len(m.Destinations) == 0 {
+		return []destination{{mapping: m, config: defaultConfig}}, nil
+	}
+	var ds []destination
+	for _, d := range m.Destinations {
+		config, err := clientcmd.BuildConfigFromFlags("", d.KubeConfig)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, destination{mapping: m.forDestination(d), config: config})
+	}
+	return ds, nil
+}
+
+//StartFanOut starts the mapping for each of its destinations, with the client set in targets under the name of the
+//destination. The destinations share the watches of the source, so every source object is watched once. A destination
+//that cannot be started is retried with backoff until ctx is done without holding up the others, and once started the
+//destinations retry their failed syncs independently. The returned channel is closed once ctx is done and all
+//destinations have stopped.
+func StartFanOut(ctx context.Context, m Mapping, sourceCS kubernetes.Interface, targets map[string]kubernetes.Interface) (<-chan struct{}, error) {
+	m.setDefaults()
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	for _, d := range m.Destinations {
+		if targets[d.Name] == nil {
+			return nil, fmt.Errorf("mapping %s: no client set for destination %s", m, d.Name)
+		}
+	}
+	m.sources = newSharedSources(ctx, m)
+	var stopped []<-chan struct{}
+	for _, d := range m.Destinations {
+		done := make(chan struct{})
+		stopped = append(stopped, done)
+		go func(m Mapping, targetCS kubernetes.Interface) {
+			defer close(done)
+			runWithRetry(ctx, "mapping "+m.String(), func(ctx context.Context) (<-chan struct{}, error) {
+				return StartMapping(ctx, m, sourceCS, targetCS)
+			})
+		}(m.forDestination(d), targets[d.Name])
+	}
+	done := make(chan struct{})
+	go func() {
+		<-joined(stopped...)
+		// the informers were started by the destinations
+		m.sources.running.Wait()
+		close(done)
+	}()
+	return done, nil
+}
+
+//targetClientSets creates a client set for every destination cluster of a fanned out mapping. The writes are dry-runs if
+//dry-run is configured.
+func targetClientSets(m Mapping) (map[string]kubernetes.Interface, error) {
+	ds, err := destinations(m, nil)
+	if err != nil {
+		return nil, err
+	}
+	targets := map[string]kubernetes.Interface{}
+	for _, d := range ds {
+		cs, err := kubernetes.NewForConfig(withDryRun(d.config))
+		if err != nil {
+			return nil, err
+		}
+		targets[d.mapping.DestinationCluster] = cs
+	}
+	return targets, nil
+}
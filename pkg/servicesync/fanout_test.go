@@ -0,0 +1,192 @@
+package servicesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestStartFanOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := NewFake()
+	source := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	if _, err := sourceCS.CoreV1().Services("foo").Create(ctx, source, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	east := fake.NewSimpleClientset()
+	west := fake.NewSimpleClientset()
+	// the west cluster is unreachable at first
+	unreachable := int32(1)
+	west.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&unreachable) == 1 {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		return false, nil, nil
+	})
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", Destinations: []Destination{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "west", KubeConfig: "west.yaml", DestinationNamespace: "baz", DestinationName: "bazService"},
+	}}
+	done, err := StartFanOut(ctx, m, sourceCS, map[string]kubernetes.Interface{"east": east, "west": west})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectService := func(cs kubernetes.Interface, namespace, name string, port int32) {
+		t.Helper()
+		s, err := cs.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Spec.Ports[0].Port != port {
+			t.Errorf("expected port %d, got %d", port, s.Spec.Ports[0].Port)
+		}
+	}
+	// the unreachable destination does not block the others
+	expectService(east, "bar", "fooService", 80)
+
+	atomic.StoreInt32(&unreachable, 0)
+	time.Sleep(2 * sleepLength)
+	expectService(west, "baz", "bazService", 80)
+	if _, err := west.CoreV1().Endpoints("baz").Get(ctx, "bazService", metav1.GetOptions{}); err != nil {
+		t.Errorf("endpoints were not created in the retried destination: %s", err)
+	}
+
+	// a change of the source reaches every destination
+	source.Spec.Ports[0].Port = 8080
+	if _, err := sourceCS.CoreV1().Services("foo").Update(ctx, source, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectService(east, "bar", "fooService", 8080)
+	expectService(west, "baz", "bazService", 8080)
+
+	// the destinations share the watches of the source
+	watches := map[string]int{}
+	for _, action := range sourceCS.Actions() {
+		if action.GetVerb() == "watch" {
+			watches[action.GetResource().Resource]++
+		}
+	}
+	if watches["services"] != 1 || watches["endpoints"] != 1 {
+		t.Errorf("expected a single watch of the source service and endpoints, got %v", watches)
+	}
+	cancel()
+	<-done
+}
+
+func TestStartFanOutWatchFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := NewFake()
+	if _, err := sourceCS.CoreV1().Services("foo").Create(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sourceCS.PrependWatchReactor("services", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, nil, errors.New("watch failed")
+	})
+	// the destination name keeps the watch names unique to this test
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "fanOutWatch", Destinations: []Destination{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "west", KubeConfig: "west.yaml"},
+	}}
+	done, err := StartFanOut(ctx, m, sourceCS, map[string]kubernetes.Interface{"east": fake.NewSimpleClientset(), "west": fake.NewSimpleClientset()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	health.lock.Lock()
+	var failing []string
+	for watch := range health.failing {
+		if strings.Contains(watch, "fanOutWatch") {
+			failing = append(failing, watch)
+		}
+	}
+	health.lock.Unlock()
+	// the shared watch is reported once, under the fanned out mapping
+	if len(failing) != 1 || failing[0] != "service "+m.String() {
+		t.Errorf("expected the watch of mapping %s to be down, got %v", m, failing)
+	}
+	cancel()
+	<-done
+}
+
+func TestSharedSourcesRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := NewFake()
+	source := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	if _, err := sourceCS.CoreV1().Services("foo").Create(ctx, source, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	targetCS := fake.NewSimpleClientset()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "fooService"}
+	m.sources = newSharedSources(ctx, m)
+	m = m.forDestination(Destination{Name: "east"})
+	// the attempts that were stopped leave the informer to the last one
+	for i := 0; i < 3; i++ {
+		actx, acancel := context.WithCancel(ctx)
+		done, err := SyncService(actx, m, sourceCS, targetCS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			acancel()
+			<-done
+		} else {
+			defer acancel()
+		}
+	}
+	time.Sleep(sleepLength)
+	i := m.sources.informers["service"]
+	i.lock.Lock()
+	syncers := len(i.syncers)
+	i.lock.Unlock()
+	if syncers != 1 {
+		t.Errorf("expected the running syncer only, got %d syncers", syncers)
+	}
+	source.Spec.Ports[0].Port = 8080
+	if _, err := sourceCS.CoreV1().Services("foo").Update(ctx, source, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	target, err := targetCS.CoreV1().Services("bar").Get(ctx, "fooService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Spec.Ports[0].Port != 8080 {
+		t.Errorf("expected port 8080, got %d", target.Spec.Ports[0].Port)
+	}
+}
+
+func TestStartFanOutInvalid(t *testing.T) {
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", Destinations: []Destination{
+		{Name: "east", KubeConfig: "east.yaml"},
+	}}
+	if _, err := StartFanOut(context.Background(), m, NewFake(), map[string]kubernetes.Interface{}); err == nil {
+		t.Error("expected a destination without client set to be rejected")
+	}
+	m.Destinations = append(m.Destinations, Destination{Name: "east", KubeConfig: "other.yaml"})
+	if err := m.validate(); err == nil {
+		t.Error("expected duplicate destinations to be rejected")
+	}
+}
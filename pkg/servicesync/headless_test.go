@@ -0,0 +1,118 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSyncHeadless(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "foo", SourceName: "kafka", DestinationNamespace: "bar", DestinationName: "kafka", Headless: true}
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kafka",
+			Namespace: "foo",
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:                corev1.ClusterIPNone,
+			PublishNotReadyAddresses: true,
+			Ports:                    []corev1.ServicePort{{Name: "broker", Port: 9092}},
+		},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kafka",
+			Namespace: "foo",
+		},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses:         []corev1.EndpointAddress{{IP: "1.2.3.4", Hostname: "kafka-0", NodeName: stringPtr("source-node")}},
+				NotReadyAddresses: []corev1.EndpointAddress{{IP: "1.2.3.5", Hostname: "kafka-1"}},
+				Ports:             []corev1.EndpointPort{{Name: "broker", Port: 9092}},
+			},
+		},
+	})
+	targetCS := fake.NewSimpleClientset()
+	done, err := StartMapping(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "kafka", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHeadless(s) || !s.Spec.PublishNotReadyAddresses || len(s.Spec.Ports) != 1 {
+		t.Errorf("expected a headless service publishing not ready addresses, got %v", s.Spec)
+	}
+	e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "kafka", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Subsets) != 1 || e.Subsets[0].Addresses[0].Hostname != "kafka-0" || e.Subsets[0].NotReadyAddresses[0].Hostname != "kafka-1" {
+		t.Errorf("hostnames were not kept: %v", e.Subsets)
+	}
+	if e.Subsets[0].Addresses[0].NodeName != nil {
+		t.Errorf("node name of the source was not dropped")
+	}
+	cancel()
+	<-done
+}
+
+func TestUpdateServiceHeadlessRecreate(t *testing.T) {
+	ctx := context.Background()
+	m := Mapping{SourceNamespace: "foo", SourceName: "kafka", DestinationNamespace: "bar", DestinationName: "kafka"}
+	targetCS := fake.NewSimpleClientset()
+	// the target service was created before the mapping became headless
+	if err := EnsureService(ctx, m, targetCS); err != nil {
+		t.Fatal(err)
+	}
+	m.Headless = true
+	if err := UpdateService(ctx, &corev1.Service{}, m, targetCS); err != nil {
+		t.Fatal(err)
+	}
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "kafka", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHeadless(s) || !isManaged(s) {
+		t.Errorf("expected the target service to be recreated headless and managed, got %v", s)
+	}
+
+	// a service that is not managed yet is not recreated
+	m = Mapping{SourceNamespace: "foo", SourceName: "zookeeper", DestinationNamespace: "bar", DestinationName: "zookeeper", Headless: true, Adopt: true}
+	targetCS = fake.NewSimpleClientset(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "zookeeper", Namespace: "bar"}})
+	if err := UpdateService(ctx, &corev1.Service{}, m, targetCS); err == nil {
+		t.Error("expected an error for a target service that is not managed")
+	}
+}
+
+func TestTransformEndpointSlicesHeadless(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "kafka", Namespace: "bar"}}
+	source := sourceSlice("kafka-abc", "kafka", "1.2.3.4")
+	slices := transformEndpointSlices([]*discoveryv1.EndpointSlice{source}, service, Mapping{Headless: true})
+	if len(slices) != 1 {
+		t.Fatalf("expected a single slice, got %d", len(slices))
+	}
+	if _, ok := slices[0].Labels[corev1.IsHeadlessService]; !ok {
+		t.Errorf("slice is not labeled headless: %v", slices[0].Labels)
+	}
+	e := slices[0].Endpoints[0]
+	if e.Hostname == nil || *e.Hostname != "pod" {
+		t.Errorf("hostname was not kept: %v", e.Hostname)
+	}
+	if e.NodeName != nil || e.TargetRef != nil {
+		t.Errorf("source references were not dropped: %v", e)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,122 @@
+package servicesync
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//defaultWatchFailureThreshold is how long a watch may be down before the process is reported as not alive.
+const defaultWatchFailureThreshold = 5 * time.Minute
+
+//Health tracks whether the initial sync is done and whether the source watches are up.
+type Health struct {
+	lock  sync.Mutex
+	ready bool
+	// failing holds when each failing watch went down, keyed by watch.
+	failing map[string]time.Time
+	// threshold is how long a watch may be down before Alive fails.
+	threshold time.Duration
+}
+
+//health is the state served on /healthz and /readyz.
+var health = NewHealth(defaultWatchFailureThreshold)
+
+//NewHealth creates a health state that is not ready and considers watches dead after threshold.
+func NewHealth(threshold time.Duration) *Health {
+	return &Health{
+		failing:   map[string]time.Time{},
+		threshold: threshold,
+	}
+}
+
+//SetReady sets whether the process is ready. A process running mappings from the configuration is ready once the
+//initial sync of every valid mapping succeeded. Mappings that fail to start are retried with backoff and hold back
+//readiness until they start, while invalid mappings and discoveries are configuration errors that are only logged and
+//do not. A process reconciling ServiceSync objects is ready once they are listed, and a standby replica is always ready.
+func (h *Health) SetReady(ready bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ready = ready
+}
+
+//Ready returns an error unless the process is ready.
+func (h *Health) Ready() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.ready {
+		return fmt.Errorf("initial sync not done")
+	}
+	return nil
+}
+
+//watchFailed marks the watch as down. A watch that is already down keeps the time it went down.
+func (h *Health) watchFailed(watch string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.failing[watch]; !ok {
+		h.failing[watch] = time.Now()
+	}
+}
+
+//watchUp marks the watch as up again. It is also used to forget watches that were stopped.
+func (h *Health) watchUp(watch string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.failing, watch)
+}
+
+//Alive returns an error if a watch has been down for longer than the threshold.
+func (h *Health) Alive() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var dead []string
+	for watch, since := range h.failing {
+		if time.Since(since) > h.threshold {
+			dead = append(dead, fmt.Sprintf("%s down since %s", watch, since.Format(time.RFC3339)))
+		}
+	}
+	if len(dead) > 0 {
+		sort.Strings(dead)
+		return fmt.Errorf("watches down for more than %s: %v", h.threshold, dead)
+	}
+	return nil
+}
+
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+//ServeHealth exposes /healthz and /readyz on health-address. An empty address disables the endpoints. Watches that are
+//down for longer than watch-failure-threshold fail /healthz.
+func ServeHealth(v *viper.Viper) {
+	if threshold := v.GetDuration("watch-failure-threshold"); threshold > 0 {
+		health.lock.Lock()
+		health.threshold = threshold
+		health.lock.Unlock()
+	}
+	addr := v.GetString("health-address")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", probeHandler(health.Alive))
+	mux.Handle("/readyz", probeHandler(health.Ready))
+	go func() {
+		logrus.Infof("serving health probes on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logrus.Fatalf("could not serve health probes on %s: %s", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+package servicesync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestHealthProbes(t *testing.T) {
+	h := NewHealth(time.Minute)
+	ready := probeHandler(h.Ready)
+	rec := httptest.NewRecorder()
+	ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready before the initial sync, got %d", rec.Code)
+	}
+	h.SetReady(true)
+	rec = httptest.NewRecorder()
+	ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected ready, got %d", rec.Code)
+	}
+
+	h.watchFailed("service foo")
+	if err := h.Alive(); err != nil {
+		t.Errorf("a watch that just went down should not fail liveness: %s", err)
+	}
+	h.failing["service foo"] = time.Now().Add(-2 * time.Minute)
+	rec = httptest.NewRecorder()
+	probeHandler(h.Alive)(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a watch down for longer than the threshold to fail liveness, got %d", rec.Code)
+	}
+	h.watchUp("service foo")
+	if err := h.Alive(); err != nil {
+		t.Errorf("expected alive once the watch is up again: %s", err)
+	}
+}
+
+func TestSyncServiceWatchFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", OnDelete: DeletionKeep}
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m.SourceName,
+			Namespace: m.SourceNamespace,
+		},
+	})
+	sourceCS.PrependWatchReactor("services", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, nil, errors.New("watch failed")
+	})
+	if _, err := SyncService(ctx, m, sourceCS, fake.NewSimpleClientset()); err != nil {
+		t.Fatal(err)
+	}
+	// the watches of other tests may be failing as well, only the one of this mapping is checked
+	failing := func() bool {
+		health.lock.Lock()
+		defer health.lock.Unlock()
+		_, ok := health.failing["service "+m.String()]
+		return ok
+	}
+	time.Sleep(sleepLength)
+	if !failing() {
+		t.Errorf("expected the failing watch to be marked as down")
+	}
+	cancel()
+	time.Sleep(sleepLength)
+	if failing() {
+		t.Errorf("expected a stopped watch to be forgotten")
+	}
+}
+
+func TestRetryStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attempts := 0
+	started := retryStart(ctx, "test", func() error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("destination unreachable")
+		}
+		return nil
+	})
+	if !started || attempts != 2 {
+		t.Errorf("expected the start to succeed on the second attempt, got %v after %d attempts", started, attempts)
+	}
+	cancel()
+	if retryStart(ctx, "test", func() error { return nil }) {
+		t.Error("expected no start once ctx is done")
+	}
+}
@@ -0,0 +1,377 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+//resyncPeriod is how often the source objects are synced to the destination even if they did not change.
+const resyncPeriod = 5 * time.Minute
+
+//syncTimeout bounds a single sync of the destination. Syncs do not use the context of the syncer, so a sync that is in
+//flight when the syncer is stopped is completed instead of aborted half way.
+const syncTimeout = 30 * time.Second
+
+//withName restricts list options to the object with the given name.
+func withName(o metav1.ListOptions, name string) metav1.ListOptions {
+	o.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	return o
+}
+
+//sourceSyncer keeps a single named source object, or the set of source objects matching a selector, in sync with the
+//destination. The informer re-establishes its watch and relists on its own, and failed syncs are retried from a rate
+//limited workqueue with exponential backoff.
+type sourceSyncer struct {
+	kind     string
+	mapping  Mapping
+	informer cache.SharedIndexInformer
+	// shared is set when the informer is shared with the syncers of the other destinations of a fanned out mapping.
+	shared *sharedInformer
+	queue  workqueue.RateLimitingInterface
+	// selector is set when the syncer aggregates all source objects matching it instead of a single named object.
+	selector labels.Selector
+	// namespace is the namespace of the aggregated objects, the source namespace of the mapping unless they are local
+	// objects in the destination.
+	namespace string
+	// observed is when the oldest change of the source object that is not synced yet was observed.
+	observedLock sync.Mutex
+	observed     time.Time
+	// sync is called with the current state of the source object, or with all matching source objects as []interface{}
+	// when a selector is set.
+	sync func(ctx context.Context, obj interface{}) error
+	// deleted is called once the source object was deleted, or once no source object matches the selector anymore.
+	deleted func(ctx context.Context) error
+	// unreachable is set when the syncer handles a source that cannot be listed or watched itself. It is called on every
+	// failure instead of failing the health of the watch, and reachable once the source can be watched again.
+	unreachable func()
+	reachable   func()
+}
+
+//newAggregateSourceSyncer creates a syncer that calls sync with all source objects in the source namespace of the
+//mapping, or all cluster scoped source objects, that match selector.
+func newAggregateSourceSyncer(kind string, m Mapping, selector labels.Selector, lw *cache.ListWatch, objType runtime.Object, sync func(ctx context.Context, obj interface{}) error, deleted func(ctx context.Context) error) *sourceSyncer {
+	s := newSourceSyncer(kind, m, lw, objType, sync, deleted)
+	s.selector = selector
+	s.namespace = m.SourceNamespace
+	return s
+}
+
+//newSourceSyncer creates a syncer with an informer for the objects of type objType listed and watched by lw.
+func newSourceSyncer(kind string, m Mapping, lw *cache.ListWatch, objType runtime.Object, sync func(ctx context.Context, obj interface{}) error, deleted func(ctx context.Context) error) *sourceSyncer {
+	s := &sourceSyncer{
+		kind:    metricKind(kind),
+		mapping: m,
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), kind+"-"+m.SourceNamespace+"-"+m.SourceName),
+		sync:    sync,
+		deleted: deleted,
+	}
+	if m.sources != nil {
+		// the events of the shared informer are dispatched to the syncer while it runs
+		s.shared = m.sources.informer(kind, func() cache.SharedIndexInformer {
+			return s.newInformer(lw, objType)
+		})
+		s.informer = s.shared.informer
+		return s
+	}
+	s.informer = s.newInformer(lw, objType)
+	s.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.enqueue,
+		UpdateFunc: func(_, obj interface{}) { s.enqueue(obj) },
+		DeleteFunc: s.enqueue,
+	})
+	return s
+}
+
+//watchContext returns the context to list and watch the source objects of the mapping with. The informers shared by the
+//destinations of a fanned out mapping outlive the syncer that created them, so they use the context of the fanned out
+//mapping.
+func watchContext(ctx context.Context, m Mapping) context.Context {
+	if m.sources != nil {
+		return m.sources.ctx
+	}
+	return ctx
+}
+
+//newInformer creates the informer of the syncer, which reports the state of its watch as the watch of the syncer.
+func (s *sourceSyncer) newInformer(lw *cache.ListWatch, objType runtime.Object) cache.SharedIndexInformer {
+	watchFunc := lw.WatchFunc
+	lw.WatchFunc = func(o metav1.ListOptions) (watch.Interface, error) {
+		w, err := watchFunc(o)
+		switch {
+		case err == nil:
+			health.watchUp(s.watchName())
+			if s.reachable != nil {
+				s.reachable()
+			}
+		case s.unreachable != nil:
+			// a refused connection is retried without calling the watch error handler
+			s.unreachable()
+		}
+		return w, err
+	}
+	informer := cache.NewSharedIndexInformer(lw, objType, resyncPeriod, cache.Indexers{})
+	informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		watchRestarts.WithLabelValues(s.watchMapping().String(), s.kind).Inc()
+		if s.unreachable != nil {
+			s.unreachable()
+		} else {
+			health.watchFailed(s.watchName())
+		}
+		cache.DefaultWatchErrorHandler(r, err)
+	})
+	return informer
+}
+
+//watchName identifies the watch of the syncer in the health state.
+func (s *sourceSyncer) watchName() string {
+	return s.kind + " " + s.watchMapping().String()
+}
+
+//watchMapping returns the mapping the watch of the syncer belongs to, which is the fanned out mapping rather than the
+//mapping to one of its destinations if the watch is shared.
+func (s *sourceSyncer) watchMapping() Mapping {
+	if s.shared != nil {
+		return s.shared.sources.mapping
+	}
+	return s.mapping
+}
+
+//matches returns whether obj is one of the source objects aggregated by the syncer.
+func (s *sourceSyncer) matches(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	o, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	// cluster scoped objects such as nodes have no namespace
+	if ns := o.GetNamespace(); ns != "" && ns != s.namespace {
+		return false
+	}
+	return s.selector.Matches(labels.Set(o.GetLabels()))
+}
+
+func (s *sourceSyncer) enqueue(obj interface{}) {
+	// all aggregated objects are synced together under the key of the mapping
+	key := s.mapping.SourceNamespace + "/" + s.mapping.SourceName
+	if s.selector != nil {
+		// the label selector is not honoured by every client, filter here as well
+		if !s.matches(obj) {
+			return
+		}
+	} else {
+		objKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			logrus.Errorf("could not get key of source %s: %s", s.kind, err)
+			return
+		}
+		// the field selector is not honoured by every client, filter here as well
+		if objKey != key {
+			return
+		}
+	}
+	s.observedLock.Lock()
+	if s.observed.IsZero() {
+		s.observed = time.Now()
+	}
+	s.observedLock.Unlock()
+	s.queue.Add(key)
+}
+
+//resync queues a sync of the source objects even if they did not change.
+func (s *sourceSyncer) resync() {
+	s.queue.Add(s.mapping.SourceNamespace + "/" + s.mapping.SourceName)
+}
+
+//get returns the source object stored under key, or all matching source objects if the syncer aggregates.
+func (s *sourceSyncer) get(key string) (interface{}, bool, error) {
+	if s.selector == nil {
+		return s.informer.GetStore().GetByKey(key)
+	}
+	var objs []interface{}
+	for _, obj := range s.informer.GetStore().List() {
+		if s.matches(obj) {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, len(objs) > 0, nil
+}
+
+//run starts the informer and waits for its cache to be filled before starting the worker. The returned channel is
+//closed once ctx is done and the informer and the worker have stopped.
+func (s *sourceSyncer) run(ctx context.Context) (<-chan struct{}, error) {
+	var wg sync.WaitGroup
+	if s.shared != nil {
+		s.shared.add(s)
+		s.shared.run(s.watchName())
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.informer.Run(ctx.Done())
+			health.watchUp(s.watchName())
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		if s.shared != nil {
+			s.shared.remove(s)
+		}
+		s.queue.ShutDown()
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), s.informer.HasSynced) {
+		return nil, fmt.Errorf("timed out waiting for the source %s %s/%s to sync", s.kind, s.mapping.SourceNamespace, s.mapping.SourceName)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		wait.Until(func() {
+			for s.processNextItem(ctx) {
+			}
+		}, time.Second, ctx.Done())
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done, nil
+}
+
+func (s *sourceSyncer) processNextItem(ctx context.Context) bool {
+	key, quit := s.queue.Get()
+	if quit {
+		return false
+	}
+	defer s.queue.Done(key)
+	if ctx.Err() != nil {
+		// stopped, drop what is left in the queue
+		return false
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	s.observedLock.Lock()
+	observed := s.observed
+	s.observed = time.Time{}
+	s.observedLock.Unlock()
+	obj, exists, err := s.get(key.(string))
+	if err == nil {
+		if exists {
+			err = s.sync(sctx, obj)
+		} else {
+			err = s.deleted(sctx)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("error while syncing %s %s, retrying: %s", s.kind, key, err)
+		s.observedLock.Lock()
+		if s.observed.IsZero() || observed.Before(s.observed) {
+			s.observed = observed
+		}
+		s.observedLock.Unlock()
+		s.queue.AddRateLimited(key)
+		return true
+	}
+	if !observed.IsZero() {
+		observePropagation(s.mapping, s.kind, observed)
+	}
+	s.queue.Forget(key)
+	return true
+}
+
+//sharedSources are the informers shared by the syncers of all destinations of a fanned out mapping, so that every
+//source object is watched once. The informers run until the context of the fanned out mapping is done, so syncers can
+//be stopped and started again with contexts of their own.
+type sharedSources struct {
+	ctx context.Context
+	// mapping is the fanned out mapping, under which the shared watches are reported.
+	mapping   Mapping
+	lock      sync.Mutex
+	informers map[string]*sharedInformer
+	// running is done once all informers that were started have stopped.
+	running sync.WaitGroup
+}
+
+//sharedInformer is an informer of sharedSources. Its events are dispatched to the syncers that are running.
+type sharedInformer struct {
+	informer cache.SharedIndexInformer
+	sources  *sharedSources
+	start    sync.Once
+	lock     sync.Mutex
+	syncers  map[*sourceSyncer]struct{}
+}
+
+func newSharedSources(ctx context.Context, m Mapping) *sharedSources {
+	return &sharedSources{ctx: ctx, mapping: m, informers: map[string]*sharedInformer{}}
+}
+
+//informer returns the informer of the kind of syncer, created by newInformer if there is none yet.
+func (ss *sharedSources) informer(kind string, newInformer func() cache.SharedIndexInformer) *sharedInformer {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if i, ok := ss.informers[kind]; ok {
+		return i
+	}
+	i := &sharedInformer{informer: newInformer(), sources: ss, syncers: map[*sourceSyncer]struct{}{}}
+	i.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    i.enqueue,
+		UpdateFunc: func(_, obj interface{}) { i.enqueue(obj) },
+		DeleteFunc: i.enqueue,
+	})
+	ss.informers[kind] = i
+	return i
+}
+
+//enqueue dispatches the event of obj to the running syncers.
+func (i *sharedInformer) enqueue(obj interface{}) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for s := range i.syncers {
+		s.enqueue(obj)
+	}
+}
+
+//add dispatches the events of the informer to s until it is removed. The objects the informer has already seen are
+//queued for s right away.
+func (i *sharedInformer) add(s *sourceSyncer) {
+	i.lock.Lock()
+	i.syncers[s] = struct{}{}
+	i.lock.Unlock()
+	for _, obj := range i.informer.GetStore().List() {
+		s.enqueue(obj)
+	}
+}
+
+//remove stops dispatching the events of the informer to s.
+func (i *sharedInformer) remove(s *sourceSyncer) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	delete(i.syncers, s)
+}
+
+//run starts the informer unless it was started already. Its watch is forgotten by the health state once it stopped.
+func (i *sharedInformer) run(watch string) {
+	i.start.Do(func() {
+		i.sources.running.Add(1)
+		go func() {
+			defer i.sources.running.Done()
+			i.informer.Run(i.sources.ctx.Done())
+			health.watchUp(watch)
+		}()
+	})
+}
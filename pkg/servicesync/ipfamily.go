@@ -0,0 +1,85 @@
+package servicesync
+
+import (
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+//ipFamilyOf returns the IP family of address, or an empty family if address is not an IP.
+func ipFamilyOf(address string) corev1.IPFamily {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return corev1.IPv4Protocol
+	default:
+		return corev1.IPv6Protocol
+	}
+}
+
+//allowsFamily returns whether family passes the IP family filter of a mapping. An empty filter allows all families.
+func allowsFamily(allowed []corev1.IPFamily, family corev1.IPFamily) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == family {
+			return true
+		}
+	}
+	return false
+}
+
+//allowsAddress returns whether the IP family of address passes the filter. Addresses that are not IPs always pass.
+func allowsAddress(allowed []corev1.IPFamily, address string) bool {
+	family := ipFamilyOf(address)
+	return family == "" || allowsFamily(allowed, family)
+}
+
+//transformIPFamilies sets the IP families and family policy of the source on the transformed service, restricted to
+//the allowed families. The settings are only carried over if the destination supports them, which is the case when
+//it reports the families of the target service. The primary family of an existing service cannot change, so the
+//target keeps its families if the primary family of the target is not among the new ones.
+func transformIPFamilies(source, target, transformed *corev1.Service, allowed []corev1.IPFamily) {
+	transformed.Spec.IPFamilies = target.Spec.IPFamilies
+	transformed.Spec.IPFamilyPolicy = target.Spec.IPFamilyPolicy
+	transformed.Spec.ClusterIPs = target.Spec.ClusterIPs
+	if len(target.Spec.IPFamilies) == 0 {
+		return
+	}
+	var families []corev1.IPFamily
+	for _, f := range source.Spec.IPFamilies {
+		if allowsFamily(allowed, f) {
+			families = append(families, f)
+		}
+	}
+	if len(families) == 0 {
+		return
+	}
+	// keep the primary family of the target first
+	primary := target.Spec.IPFamilies[0]
+	ordered := []corev1.IPFamily{primary}
+	for _, f := range families {
+		if f != primary {
+			ordered = append(ordered, f)
+		}
+	}
+	if len(ordered) > len(families) {
+		return
+	}
+	policy := corev1.IPFamilyPolicySingleStack
+	if source.Spec.IPFamilyPolicy != nil {
+		policy = *source.Spec.IPFamilyPolicy
+	}
+	if len(ordered) == 1 {
+		policy = corev1.IPFamilyPolicySingleStack
+	}
+	transformed.Spec.IPFamilies = ordered
+	transformed.Spec.IPFamilyPolicy = &policy
+	// the server allocates the cluster IPs of added families, the cluster IPs of removed families have to be dropped
+	if len(transformed.Spec.ClusterIPs) > len(ordered) {
+		transformed.Spec.ClusterIPs = transformed.Spec.ClusterIPs[:len(ordered)]
+	}
+}
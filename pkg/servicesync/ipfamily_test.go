@@ -0,0 +1,149 @@
+package servicesync
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func dualStackService(name, namespace string, families ...corev1.IPFamily) *corev1.Service {
+	policy := corev1.IPFamilyPolicySingleStack
+	if len(families) > 1 {
+		policy = corev1.IPFamilyPolicyRequireDualStack
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			IPFamilies:     families,
+			IPFamilyPolicy: &policy,
+		},
+	}
+}
+
+func TestTransformIPFamilies(t *testing.T) {
+	source := dualStackService("fooService", "foo", corev1.IPv6Protocol, corev1.IPv4Protocol)
+	tests := []struct {
+		name         string
+		target       *corev1.Service
+		allowed      []corev1.IPFamily
+		wantFamilies []corev1.IPFamily
+		wantPolicy   corev1.IPFamilyPolicyType
+	}{
+		{
+			name:         "destination without dual-stack support",
+			target:       &corev1.Service{},
+			wantFamilies: nil,
+		},
+		{
+			name:         "primary family of the target is kept",
+			target:       dualStackService("barService", "bar", corev1.IPv4Protocol),
+			wantFamilies: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol},
+			wantPolicy:   corev1.IPFamilyPolicyRequireDualStack,
+		},
+		{
+			name:         "filtered to a single family",
+			target:       dualStackService("barService", "bar", corev1.IPv6Protocol, corev1.IPv4Protocol),
+			allowed:      []corev1.IPFamily{corev1.IPv6Protocol},
+			wantFamilies: []corev1.IPFamily{corev1.IPv6Protocol},
+			wantPolicy:   corev1.IPFamilyPolicySingleStack,
+		},
+		{
+			name:         "primary family of the target filtered out",
+			target:       dualStackService("barService", "bar", corev1.IPv4Protocol),
+			allowed:      []corev1.IPFamily{corev1.IPv6Protocol},
+			wantFamilies: []corev1.IPFamily{corev1.IPv4Protocol},
+			wantPolicy:   corev1.IPFamilyPolicySingleStack,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformed := transformService(source, tt.target, Mapping{IPFamilies: tt.allowed})
+			if !reflect.DeepEqual(transformed.Spec.IPFamilies, tt.wantFamilies) {
+				t.Errorf("expected families %v, got %v", tt.wantFamilies, transformed.Spec.IPFamilies)
+			}
+			if tt.wantPolicy != "" && (transformed.Spec.IPFamilyPolicy == nil || *transformed.Spec.IPFamilyPolicy != tt.wantPolicy) {
+				t.Errorf("expected policy %s, got %v", tt.wantPolicy, transformed.Spec.IPFamilyPolicy)
+			}
+		})
+	}
+}
+
+func TestTransformEndpointsIPFamilies(t *testing.T) {
+	source := &corev1.Endpoints{
+		Subsets: []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.2.3.4"}, {IP: "fd00::1"}}},
+			{Addresses: []corev1.EndpointAddress{{IP: "fd00::2"}}},
+		},
+	}
+	all := transformEndpoints(source, Mapping{DestinationNamespace: "bar", DestinationName: "barService"})
+	if len(all.Subsets) != 2 || len(all.Subsets[0].Addresses) != 2 {
+		t.Errorf("expected all addresses without a filter, got %v", all.Subsets)
+	}
+	ipv4 := transformEndpoints(source, Mapping{DestinationNamespace: "bar", DestinationName: "barService", IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol}})
+	if len(ipv4.Subsets) != 1 || len(ipv4.Subsets[0].Addresses) != 1 || ipv4.Subsets[0].Addresses[0].IP != "1.2.3.4" {
+		t.Errorf("expected only the IPv4 address, got %v", ipv4.Subsets)
+	}
+}
+
+func TestTransformEndpointSlicesIPFamilies(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "barService", Namespace: "bar"}}
+	ipv4 := sourceSlice("fooService-abc", "fooService", "1.2.3.4")
+	ipv6 := sourceSlice("fooService-def", "fooService", "fd00::1")
+	ipv6.AddressType = discoveryv1.AddressTypeIPv6
+	// an IPv4 address in an IPv6 slice is skipped
+	mixed := sourceSlice("fooService-ghi", "fooService", "fd00::2", "1.2.3.5")
+	mixed.AddressType = discoveryv1.AddressTypeIPv6
+
+	slices := transformEndpointSlices([]*discoveryv1.EndpointSlice{ipv4, ipv6, mixed}, service, Mapping{})
+	found := map[discoveryv1.AddressType]int{}
+	for _, slice := range slices {
+		found[slice.AddressType] += len(slice.Endpoints)
+	}
+	if len(slices) != 2 || found[discoveryv1.AddressTypeIPv4] != 1 || found[discoveryv1.AddressTypeIPv6] != 2 {
+		t.Errorf("expected one slice per family, got %v", found)
+	}
+
+	slices = transformEndpointSlices([]*discoveryv1.EndpointSlice{ipv4, ipv6}, service, Mapping{IPFamilies: []corev1.IPFamily{corev1.IPv6Protocol}})
+	if len(slices) != 1 || slices[0].AddressType != discoveryv1.AddressTypeIPv6 {
+		t.Errorf("expected only the IPv6 slice, got %v", slices)
+	}
+}
+
+func TestUpdateServiceIPFamiliesUnsupported(t *testing.T) {
+	ctx := context.Background()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", Adopt: true}
+	targetCS := fake.NewSimpleClientset(dualStackService("barService", "bar", corev1.IPv4Protocol))
+	// the destination is single-stack and rejects a second family
+	targetCS.PrependReactor("update", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		s := action.(k8stesting.UpdateAction).GetObject().(*corev1.Service)
+		if len(s.Spec.IPFamilies) > 1 {
+			return true, nil, k8serror.NewInvalid(schema.GroupKind{Kind: "Service"}, s.Name, field.ErrorList{field.Invalid(field.NewPath("spec", "ipFamilies"), s.Spec.IPFamilies, "not dual-stack")})
+		}
+		return false, nil, nil
+	})
+	source := dualStackService("fooService", "foo", corev1.IPv4Protocol, corev1.IPv6Protocol)
+	source.Spec.Ports = []corev1.ServicePort{{Port: 81}}
+	if err := UpdateService(ctx, source, m, targetCS); err != nil {
+		t.Fatal(err)
+	}
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Spec.IPFamilies) != 1 || len(s.Spec.Ports) != 1 {
+		t.Errorf("expected the service to be updated with its families kept, got families %v and ports %v", s.Spec.IPFamilies, s.Spec.Ports)
+	}
+}
@@ -0,0 +1,162 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+//serviceAccountNamespaceFile holds the namespace of the pod when running in cluster.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+//LeaderElection configures the Lease in the destination cluster that replicas compete for. Only the holder of the
+//Lease synchronizes, the other replicas wait and take over once it is not renewed anymore.
+type LeaderElection struct {
+	//LeaseDuration is how long standby replicas wait after the last renewal before taking over.
+	LeaseDuration time.Duration
+	//RenewDeadline is how long the leader retries renewing before giving up the Lease.
+	RenewDeadline time.Duration
+	//RetryPeriod is how often replicas try to acquire or renew the Lease.
+	RetryPeriod time.Duration
+	Namespace   string
+	Name        string
+}
+
+//LeaderElectionFromConfig reads the leader-elect-* keys. It returns nil when leader election is disabled.
+func LeaderElectionFromConfig(v *viper.Viper) *LeaderElection {
+	if !v.GetBool("leader-elect") {
+		return nil
+	}
+	l := &LeaderElection{
+		LeaseDuration: v.GetDuration("leader-elect-lease-duration"),
+		RenewDeadline: v.GetDuration("leader-elect-renew-deadline"),
+		RetryPeriod:   v.GetDuration("leader-elect-retry-period"),
+		Namespace:     v.GetString("leader-elect-namespace"),
+		Name:          v.GetString("leader-elect-name"),
+	}
+	if l.Namespace == "" {
+		l.Namespace = "default"
+		if ns, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+			l.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	if l.Name == "" {
+		l.Name = "servicesync"
+	}
+	return l
+}
+
+//Run blocks until identity holds the Lease and then calls run. The context passed to run is cancelled when the Lease
+//is lost. Run returns once the Lease is lost or ctx is done and run has returned.
+func (l LeaderElection) Run(ctx context.Context, identity string, cs kubernetes.Interface, run func(ctx context.Context)) error {
+	// running tracks run so that Run does not return while run is still stopping.
+	var (
+		runningLock sync.Mutex
+		stopped     bool
+		running     sync.WaitGroup
+	)
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: l.Namespace,
+			Name:      l.Name,
+		},
+		Client: cs.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   l.LeaseDuration,
+		RenewDeadline:   l.RenewDeadline,
+		RetryPeriod:     l.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.Namespace + "/" + l.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				runningLock.Lock()
+				if stopped {
+					runningLock.Unlock()
+					return
+				}
+				running.Add(1)
+				runningLock.Unlock()
+				defer running.Done()
+				logrus.Infof("%s acquired lease %s/%s", identity, l.Namespace, l.Name)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				logrus.Infof("%s stopped leading lease %s/%s", identity, l.Namespace, l.Name)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logrus.Infof("waiting for lease %s/%s held by %s", l.Namespace, l.Name, leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid leader election configuration: %s", err)
+	}
+	le.Run(ctx)
+	runningLock.Lock()
+	stopped = true
+	runningLock.Unlock()
+	running.Wait()
+	return nil
+}
+
+//leaderElectionConfig returns the config of the destination cluster that holds the Lease. The Lease is written for real
+//in a dry-run, so that only one replica runs the mappings.
+func leaderElectionConfig(v *viper.Viper) *rest.Config {
+	if config, ok := v.Get("leader-election-kube-config").(*rest.Config); ok {
+		return config
+	}
+	return v.Get("destination-kube-config").(*rest.Config)
+}
+
+//runWithLeaderElection calls run right away if leader election is disabled. Otherwise run is only called once this
+//process holds the Lease in the destination cluster, and the process exits when the Lease is lost so that it restarts
+//as a standby replica. It returns once ctx is done and run has returned.
+func runWithLeaderElection(ctx context.Context, v *viper.Viper, run func(ctx context.Context)) {
+	l := LeaderElectionFromConfig(v)
+	if l == nil {
+		run(ctx)
+		return
+	}
+	cs, err := kubernetes.NewForConfig(leaderElectionConfig(v))
+	if err != nil {
+		logrus.Fatalf("unexpected error while creating destination client set: %s", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logrus.Fatalf("could not determine leader election identity: %s", err)
+	}
+	identity := hostname + "_" + string(uuid.NewUUID())
+	logrus.Infof("%s waiting to acquire lease %s/%s", identity, l.Namespace, l.Name)
+	// standby replicas are ready to take over, the leader is ready once its initial sync is done
+	health.SetReady(true)
+	if err := l.Run(ctx, identity, cs, func(ctx context.Context) {
+		health.SetReady(false)
+		run(ctx)
+	}); err != nil {
+		logrus.Fatal(err)
+	}
+	if ctx.Err() == nil {
+		logrus.Fatalf("lost lease %s/%s", l.Namespace, l.Name)
+	}
+}
@@ -0,0 +1,79 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElectionFromConfig(t *testing.T) {
+	v := viper.New()
+	if l := LeaderElectionFromConfig(v); l != nil {
+		t.Errorf("expected leader election to be disabled, got %+v", l)
+	}
+	v.Set("leader-elect", true)
+	v.Set("leader-elect-lease-duration", "15s")
+	v.Set("leader-elect-namespace", "servicesync")
+	l := LeaderElectionFromConfig(v)
+	if l == nil {
+		t.Fatalf("expected leader election to be enabled")
+	}
+	if l.LeaseDuration != 15*time.Second {
+		t.Errorf("unexpected lease duration %s", l.LeaseDuration)
+	}
+	if l.Namespace != "servicesync" || l.Name != "servicesync" {
+		t.Errorf("unexpected lease %s/%s", l.Namespace, l.Name)
+	}
+}
+
+func TestLeaderElectionTakeover(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	l := LeaderElection{
+		LeaseDuration: 2 * time.Second,
+		RenewDeadline: time.Second,
+		RetryPeriod:   200 * time.Millisecond,
+		Namespace:     "servicesync",
+		Name:          "servicesync",
+	}
+	leading := make(chan string, 2)
+	candidate := func(ctx context.Context, identity string) {
+		if err := l.Run(ctx, identity, cs, func(context.Context) { leading <- identity }); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	go candidate(firstCtx, "first")
+	select {
+	case id := <-leading:
+		if id != "first" {
+			t.Fatalf("expected first to lead, got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("first did not acquire the lease")
+	}
+
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	go candidate(secondCtx, "second")
+	time.Sleep(sleepLength)
+	select {
+	case id := <-leading:
+		t.Fatalf("%s started leading while first holds the lease", id)
+	default:
+	}
+
+	// the first replica releases the lease when it stops
+	stopFirst()
+	select {
+	case id := <-leading:
+		if id != "second" {
+			t.Fatalf("expected second to take over, got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second did not take over the lease")
+	}
+}
@@ -0,0 +1,172 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+//Resolver looks up the addresses of load balancer ingresses that only have a hostname.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+//resolver is used by all mappings in load-balancer mode. It is the system resolver unless configured otherwise.
+var resolver Resolver = net.DefaultResolver
+
+//ConfigureResolver sets the resolver of load balancer hostnames to the DNS server at the resolver address. An empty
+//address keeps the system resolver. Port 53 is used if the address has no port.
+func ConfigureResolver(v *viper.Viper) {
+	addr := v.GetString("resolver")
+	if addr == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	logrus.Infof("resolving load balancer hostnames with %s", addr)
+	resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+//GetAndUpdateLoadBalancerEndpoints does a one time sync of the target endpoints from the load balancer ingresses of
+//the source service.
+func GetAndUpdateLoadBalancerEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	s, err := sourceCS.CoreV1().Services(m.SourceNamespace).Get(ctx, m.SourceName, metav1.GetOptions{})
+	if err != nil {
+		logrus.Errorf("error while getting service definition from source: %s", err)
+		return err
+	}
+	endpoints, err := loadBalancerEndpoints(ctx, s, m)
+	if err != nil {
+		return err
+	}
+	return UpdateEndpoints(ctx, endpoints, m, targetCS)
+}
+
+//SyncLoadBalancerEndpoints keeps the target endpoints pointed at the load balancer ingresses of the source service
+//until ctx is done. Hostnames are resolved again whenever the source service changes and on every resync. A deleted
+//source service is handled according to the OnDelete policy of the mapping. The returned channel is closed once ctx is
+//done and the sync in flight, if any, has completed.
+func SyncLoadBalancerEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	wctx := watchContext(ctx, m)
+	lw := &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			return sourceCS.CoreV1().Services(m.SourceNamespace).List(wctx, withName(o, m.SourceName))
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			return sourceCS.CoreV1().Services(m.SourceNamespace).Watch(wctx, withName(o, m.SourceName))
+		},
+	}
+	// added is true until the source has been synced and again once it was deleted, see SyncEndpoints.
+	added := true
+	s := newSourceSyncer("load-balancer-service", m, lw, &corev1.Service{}, func(ctx context.Context, obj interface{}) error {
+		endpoints, err := loadBalancerEndpoints(ctx, obj.(*corev1.Service), m)
+		if err != nil {
+			return err
+		}
+		if added {
+			if err := EnsureEndpoints(ctx, m, targetCS); err != nil {
+				return err
+			}
+		}
+		if err := UpdateEndpoints(ctx, endpoints, m, targetCS); err != nil {
+			added = k8serror.IsNotFound(err)
+			return err
+		}
+		added = false
+		return nil
+	}, func(ctx context.Context) error {
+		added = true
+		switch m.OnDelete {
+		case DeletionDelete:
+			logrus.Infof("source service of mapping %s was deleted, deleting target endpoints", m)
+			return DeleteEndpoints(ctx, m.DestinationNamespace, m.DestinationName, targetCS)
+		case DeletionBlank:
+			logrus.Infof("source service of mapping %s was deleted, removing all target endpoints", m)
+			return UpdateEndpoints(ctx, &corev1.Endpoints{}, m, targetCS)
+		}
+		return nil
+	})
+	done, err := s.run(ctx)
+	if err != nil {
+		logrus.Errorf("error while establishing a watch connection from source: %s", err)
+		return nil, err
+	}
+	return done, nil
+}
+
+//loadBalancerEndpoints builds endpoints with an address per load balancer ingress of the source service and a port per
+//service port. Ingresses that only have a hostname are resolved. A hostname that cannot be resolved is an error, so the
+//target endpoints are kept until it can be.
+func loadBalancerEndpoints(ctx context.Context, service *corev1.Service, m Mapping) (*corev1.Endpoints, error) {
+	endpoints := &corev1.Endpoints{}
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		logrus.Warnf("source service of mapping %s is of type %s, not %s", m, service.Spec.Type, corev1.ServiceTypeLoadBalancer)
+	}
+	seen := map[string]bool{}
+	var addresses []string
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		ips := []string{ingress.IP}
+		if ingress.IP == "" {
+			if ingress.Hostname == "" {
+				continue
+			}
+			var err error
+			ips, err = resolver.LookupHost(ctx, ingress.Hostname)
+			if err != nil {
+				return nil, fmt.Errorf("could not resolve load balancer %s of mapping %s: %s", ingress.Hostname, m, err)
+			}
+		}
+		for _, ip := range ips {
+			if !seen[ip] {
+				seen[ip] = true
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		// the load balancer is not provisioned yet
+		return endpoints, nil
+	}
+	sort.Strings(addresses)
+	var subset corev1.EndpointSubset
+	for _, a := range addresses {
+		subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{IP: a})
+	}
+	for _, p := range service.Spec.Ports {
+		subset.Ports = append(subset.Ports, corev1.EndpointPort{Name: p.Name, Port: p.Port, Protocol: p.Protocol})
+	}
+	endpoints.Subsets = []corev1.EndpointSubset{subset}
+	return endpoints, nil
+}
+
+//loadBalancerServicePorts points the target ports of the destination service at the ports the load balancer of the
+//source listens on. The node ports of the source are not allocated in the destination.
+func loadBalancerServicePorts(ports []corev1.ServicePort) []corev1.ServicePort {
+	var transformed []corev1.ServicePort
+	for _, p := range ports {
+		p.TargetPort = intstr.FromInt(int(p.Port))
+		p.NodePort = 0
+		transformed = append(transformed, p)
+	}
+	return transformed
+}
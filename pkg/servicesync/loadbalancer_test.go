@@ -0,0 +1,118 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+//fakeResolver resolves the hostnames in its map and fails for all others.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addresses, ok := r[host]; ok {
+		return addresses, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+func withResolver(t *testing.T, r Resolver) {
+	previous := resolver
+	resolver = r
+	t.Cleanup(func() { resolver = previous })
+}
+
+func loadBalancerService(ingress ...corev1.LoadBalancerIngress) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{Ingress: ingress},
+		},
+	}
+}
+
+func TestLoadBalancerEndpoints(t *testing.T) {
+	withResolver(t, fakeResolver{"lb.example.com": {"198.51.100.2", "198.51.100.1"}})
+	ctx := context.Background()
+	service := loadBalancerService(corev1.LoadBalancerIngress{IP: "203.0.113.1"}, corev1.LoadBalancerIngress{Hostname: "lb.example.com"})
+	endpoints, err := loadBalancerEndpoints(ctx, service, Mapping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints.Subsets) != 1 || len(endpoints.Subsets[0].Addresses) != 3 {
+		t.Fatalf("expected a subset with 3 addresses, got %v", endpoints.Subsets)
+	}
+	if a := endpoints.Subsets[0].Addresses; a[0].IP != "198.51.100.1" || a[2].IP != "203.0.113.1" {
+		t.Errorf("expected sorted addresses, got %v", a)
+	}
+	if p := endpoints.Subsets[0].Ports; len(p) != 1 || p[0].Port != 80 {
+		t.Errorf("expected the service port, got %v", p)
+	}
+
+	// a hostname that cannot be resolved keeps the target endpoints
+	if _, err := loadBalancerEndpoints(ctx, loadBalancerService(corev1.LoadBalancerIngress{Hostname: "unknown.example.com"}), Mapping{}); err == nil {
+		t.Error("expected an error for a hostname that cannot be resolved")
+	}
+	// a load balancer that is not provisioned yet has no endpoints
+	endpoints, err = loadBalancerEndpoints(ctx, loadBalancerService(), Mapping{})
+	if err != nil || len(endpoints.Subsets) != 0 {
+		t.Errorf("expected no subsets, got %v, %v", endpoints, err)
+	}
+}
+
+func TestTransformServiceLoadBalancer(t *testing.T) {
+	transformed := transformService(loadBalancerService(), &corev1.Service{}, Mapping{EndpointMode: EndpointModeLoadBalancer})
+	if transformed.Spec.Type != corev1.ServiceTypeClusterIP {
+		t.Errorf("expected a ClusterIP service, got %s", transformed.Spec.Type)
+	}
+	if p := transformed.Spec.Ports[0]; p.NodePort != 0 || p.TargetPort.IntValue() != 80 {
+		t.Errorf("expected port 80 to target the load balancer port, got %v", p)
+	}
+}
+
+func TestSyncLoadBalancerEndpoints(t *testing.T) {
+	withResolver(t, fakeResolver{"lb.example.com": {"198.51.100.1"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", EndpointMode: EndpointModeLoadBalancer}
+	sourceCS := fake.NewSimpleClientset(loadBalancerService())
+	targetCS := fake.NewSimpleClientset()
+	done, err := StartMapping(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		t.Error("a second load balancer would be provisioned in the destination")
+	}
+
+	// the load balancer is provisioned
+	if _, err := sourceCS.CoreV1().Services("foo").UpdateStatus(ctx, loadBalancerService(corev1.LoadBalancerIngress{Hostname: "lb.example.com"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Subsets) != 1 || len(e.Subsets[0].Addresses) != 1 || e.Subsets[0].Addresses[0].IP != "198.51.100.1" {
+		t.Errorf("expected the resolved load balancer address, got %v", e.Subsets)
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,214 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+//localEndpoints are the destination endpoints of a mapping with a local selector. They hold the addresses of the local
+//pods, and the addresses of the source as long as too few local pods are ready.
+type localEndpoints struct {
+	mapping  Mapping
+	targetCS kubernetes.Interface
+	lock     sync.Mutex
+	// remote are the endpoints of the source, nil until they were synced.
+	remote *corev1.Endpoints
+	pods   []*corev1.Pod
+	// synced is true once the local pods were listed. The destination is not written before, so that the source is not
+	// published while the local pods are unknown.
+	synced bool
+	// failover is true while the endpoints of the source are published.
+	failover bool
+}
+
+//SyncLocalEndpoints keeps the local pods of the mapping in its destination endpoints until ctx is done. It returns the
+//mapping to sync the source endpoints with, whose updates are merged with the local pods. The returned channel is
+//closed once ctx is done and the sync in flight, if any, has completed.
+func SyncLocalEndpoints(ctx context.Context, m Mapping, targetCS kubernetes.Interface) (Mapping, <-chan struct{}, error) {
+	selector, err := labels.Parse(m.LocalSelector)
+	if err != nil {
+		return m, nil, err
+	}
+	l := &localEndpoints{mapping: m, targetCS: targetCS}
+	lw := &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			o.LabelSelector = m.LocalSelector
+			return targetCS.CoreV1().Pods(m.DestinationNamespace).List(ctx, o)
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			o.LabelSelector = m.LocalSelector
+			return targetCS.CoreV1().Pods(m.DestinationNamespace).Watch(ctx, o)
+		},
+	}
+	// the pods are in the destination, so their watch is never shared with the other destinations of a fanned out
+	// mapping
+	lm := m
+	lm.sources = nil
+	s := newAggregateSourceSyncer("local-pods", lm, selector, lw, &corev1.Pod{}, func(ctx context.Context, obj interface{}) error {
+		var pods []*corev1.Pod
+		for _, o := range obj.([]interface{}) {
+			pods = append(pods, o.(*corev1.Pod))
+		}
+		return l.updateLocal(ctx, pods)
+	}, func(ctx context.Context) error {
+		return l.updateLocal(ctx, nil)
+	})
+	// the pods are in the destination
+	s.namespace = m.DestinationNamespace
+	done, err := s.run(ctx)
+	if err != nil {
+		logrus.Errorf("error while establishing a watch connection from destination: %s", err)
+		return m, nil, err
+	}
+	// without local pods there is no event that syncs them
+	s.resync()
+	m.local = l
+	return m, done, nil
+}
+
+//updateLocalEndpoints merges the endpoints of the source with the local pods of a mapping with a local selector and
+//writes them to the destination. Without running local endpoints the local pods are listed once.
+func updateLocalEndpoints(ctx context.Context, source *corev1.Endpoints, m Mapping, targetCS kubernetes.Interface) error {
+	l := m.local
+	if l == nil {
+		pods, err := targetCS.CoreV1().Pods(m.DestinationNamespace).List(ctx, metav1.ListOptions{LabelSelector: m.LocalSelector})
+		if err != nil {
+			logrus.Errorf("error while listing local pods: %s", err)
+			return err
+		}
+		l = &localEndpoints{mapping: m, targetCS: targetCS, synced: true}
+		for i := range pods.Items {
+			l.pods = append(l.pods, &pods.Items[i])
+		}
+	}
+	return l.updateRemote(ctx, source)
+}
+
+//updateRemote sets the endpoints of the source and writes the destination endpoints.
+func (l *localEndpoints) updateRemote(ctx context.Context, remote *corev1.Endpoints) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.remote = remote
+	if !l.synced {
+		return nil
+	}
+	return l.write(ctx)
+}
+
+//updateLocal sets the local pods and writes the destination endpoints.
+func (l *localEndpoints) updateLocal(ctx context.Context, pods []*corev1.Pod) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.pods = pods
+	l.synced = true
+	return l.write(ctx)
+}
+
+func (l *localEndpoints) write(ctx context.Context) error {
+	m := l.mapping
+	// the ports of the local pods are found through the target ports of the destination service
+	service, err := l.targetCS.CoreV1().Services(m.DestinationNamespace).Get(ctx, m.DestinationName, metav1.GetOptions{})
+	if err != nil {
+		logrus.Errorf("error while getting existing target service: %s", err)
+		return err
+	}
+	subsets, ready := localSubsets(l.pods, service.Spec.Ports)
+	endpoints := &corev1.Endpoints{Subsets: subsets}
+	failover := ready < m.FailoverThreshold
+	if failover && l.remote != nil {
+		endpoints.Subsets = append(endpoints.Subsets, l.remote.Subsets...)
+	}
+	if err := writeEndpoints(ctx, endpoints, m, l.targetCS); err != nil {
+		return err
+	}
+	if failover != l.failover {
+		if failover {
+			logrus.Warnf("%d of %d required local pods of mapping %s are ready, publishing the source endpoints", ready, m.FailoverThreshold, m)
+		} else {
+			logrus.Infof("%d local pods of mapping %s are ready, withdrawing the source endpoints", ready, m)
+		}
+		l.failover = failover
+	}
+	return nil
+}
+
+//localSubsets returns the endpoint subsets of the pods for the service ports and the number of ready pods. Pods that
+//are terminating, finished or have no IP yet are left out, and so are pods without any of the target ports.
+func localSubsets(pods []*corev1.Pod, servicePorts []corev1.ServicePort) ([]corev1.EndpointSubset, int) {
+	sorted := append([]*corev1.Pod(nil), pods...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	// pods with the same ports share a subset
+	var subsets []corev1.EndpointSubset
+	index := map[string]int{}
+	ready := 0
+	for _, pod := range sorted {
+		if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		var ports []corev1.EndpointPort
+		for _, sp := range servicePorts {
+			if port, ok := findPort(pod, sp); ok {
+				ports = append(ports, corev1.EndpointPort{Name: sp.Name, Port: port, Protocol: sp.Protocol})
+			}
+		}
+		if len(ports) == 0 {
+			continue
+		}
+		key := fmt.Sprint(ports)
+		i, ok := index[key]
+		if !ok {
+			i = len(subsets)
+			index[key] = i
+			subsets = append(subsets, corev1.EndpointSubset{Ports: ports})
+		}
+		address := corev1.EndpointAddress{IP: pod.Status.PodIP, Hostname: pod.Spec.Hostname}
+		if podReady(pod) {
+			subsets[i].Addresses = append(subsets[i].Addresses, address)
+			ready++
+		} else {
+			subsets[i].NotReadyAddresses = append(subsets[i].NotReadyAddresses, address)
+		}
+	}
+	return subsets, ready
+}
+
+//findPort returns the port of the pod the service port targets. A named target port has to be a container port of the
+//pod with the protocol of the service port.
+func findPort(pod *corev1.Pod, sp corev1.ServicePort) (int32, bool) {
+	switch {
+	case sp.TargetPort.Type == intstr.String:
+		for _, c := range pod.Spec.Containers {
+			for _, p := range c.Ports {
+				if p.Name == sp.TargetPort.StrVal && p.Protocol == sp.Protocol {
+					return p.ContainerPort, true
+				}
+			}
+		}
+		return 0, false
+	case sp.TargetPort.IntVal != 0:
+		return sp.TargetPort.IntVal, true
+	}
+	return sp.Port, true
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
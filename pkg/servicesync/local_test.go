@@ -0,0 +1,173 @@
+package servicesync
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func localPod(name, ip string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "bar", Labels: map[string]string{"app": "foo"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "foo",
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+		}}},
+		Status: corev1.PodStatus{
+			PodIP:      ip,
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestLocalSubsets(t *testing.T) {
+	terminating := localPod("terminating", "10.0.0.4", true)
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	pods := []*corev1.Pod{
+		localPod("b", "10.0.0.2", false),
+		localPod("a", "10.0.0.1", true),
+		localPod("pending", "", false),
+		terminating,
+	}
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, TargetPort: intstr.FromString("http")},
+		{Name: "metrics", Port: 9090},
+		{Name: "missing", Port: 81, TargetPort: intstr.FromString("missing")},
+	}
+	subsets, ready := localSubsets(pods, ports)
+	expected := []corev1.EndpointSubset{{
+		Addresses:         []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+		NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.2"}},
+		Ports:             []corev1.EndpointPort{{Name: "http", Port: 8080}, {Name: "metrics", Port: 9090}},
+	}}
+	if ready != 1 || !reflect.DeepEqual(subsets, expected) {
+		t.Errorf("expected %d ready in %v, got %d in %v", 1, expected, ready, subsets)
+	}
+}
+
+func TestStartMappingLocal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := NewFake()
+	if _, err := sourceCS.CoreV1().Services("foo").Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromString("http")}}},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	targetCS := fake.NewSimpleClientset(localPod("local-1", "10.0.0.1", true), localPod("other", "10.0.0.9", true))
+	// the other pod is not selected
+	other, _ := targetCS.CoreV1().Pods("bar").Get(ctx, "other", metav1.GetOptions{})
+	other.Labels = nil
+	if _, err := targetCS.CoreV1().Pods("bar").Update(ctx, other, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", LocalSelector: "app=foo"}
+	done, err := StartMapping(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIPs := func(want ...string) {
+		t.Helper()
+		e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "fooService", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ips []string
+		for _, s := range e.Subsets {
+			for _, a := range s.Addresses {
+				ips = append(ips, a.IP)
+			}
+		}
+		sort.Strings(ips)
+		if !reflect.DeepEqual(ips, want) {
+			t.Errorf("expected addresses %v, got %v", want, ips)
+		}
+	}
+	expectIPs("10.0.0.1")
+	time.Sleep(sleepLength)
+	expectIPs("10.0.0.1")
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "fooService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Spec.Selector != nil {
+		t.Errorf("expected no selector on the destination service, got %v", s.Spec.Selector)
+	}
+
+	// the source is published once no local pod is ready
+	if _, err := targetCS.CoreV1().Pods("bar").UpdateStatus(ctx, localPod("local-1", "10.0.0.1", false), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectIPs("1.2.3.4")
+
+	// and withdrawn once a local pod is ready again
+	if _, err := targetCS.CoreV1().Pods("bar").Create(ctx, localPod("local-2", "10.0.0.2", true), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectIPs("10.0.0.2")
+	cancel()
+	<-done
+}
+
+func TestValidateLocalSelector(t *testing.T) {
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", LocalSelector: "app in (foo"}
+	if err := m.validate(); err == nil {
+		t.Error("expected an invalid local selector to be rejected")
+	}
+	m.LocalSelector = "app=foo"
+	m.EndpointSlices = true
+	if err := m.validate(); err == nil {
+		t.Error("expected a local selector with endpoint slices to be rejected")
+	}
+}
+
+func TestStartFanOutLocal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sourceCS := NewFake()
+	if _, err := sourceCS.CoreV1().Services("foo").Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromString("http")}}},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	east := fake.NewSimpleClientset(localPod("east-1", "10.1.0.1", true))
+	west := fake.NewSimpleClientset(localPod("west-1", "10.2.0.1", true))
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", LocalSelector: "app=foo", Destinations: []Destination{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "west", KubeConfig: "west.yaml"},
+	}}
+	done, err := StartFanOut(ctx, m, sourceCS, map[string]kubernetes.Interface{"east": east, "west": west})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	// every destination publishes its own local pods
+	for cs, want := range map[kubernetes.Interface]string{east: "10.1.0.1", west: "10.2.0.1"} {
+		e, err := cs.CoreV1().Endpoints("bar").Get(ctx, "fooService", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.Subsets) != 1 || len(e.Subsets[0].Addresses) != 1 || e.Subsets[0].Addresses[0].IP != want {
+			t.Errorf("expected address %s, got %v", want, e.Subsets)
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,109 @@
+package servicesync
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+//Manager starts and stops mappings at runtime and keeps track of which mappings are running.
+type Manager struct {
+	cluster  string
+	sourceCS kubernetes.Interface
+	targetCS kubernetes.Interface
+
+	lock    sync.Mutex
+	running map[string]*runningMapping
+	// stopped is done once every mapping that was started has stopped.
+	stopped sync.WaitGroup
+}
+
+//runningMapping is a mapping started by a Manager. done is closed once the mapping has stopped, or once it failed to
+//start.
+type runningMapping struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+//NewManager creates a manager that synchronizes mappings from the named source cluster to the target cluster.
+func NewManager(cluster string, sourceCS, targetCS kubernetes.Interface) *Manager {
+	return &Manager{
+		cluster:  cluster,
+		sourceCS: sourceCS,
+		targetCS: targetCS,
+		running:  map[string]*runningMapping{},
+	}
+}
+
+//Start starts synchronizing the mapping. Starting a mapping that is already running, or still starting, is a no-op. The
+//mapping counts as running while it starts, so that it can be stopped meanwhile.
+func (mgr *Manager) Start(ctx context.Context, m Mapping) error {
+	mgr.lock.Lock()
+	if _, ok := mgr.running[m.String()]; ok {
+		mgr.lock.Unlock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		mgr.lock.Unlock()
+		return err
+	}
+	mctx, cancel := context.WithCancel(ctx)
+	r := &runningMapping{cancel: cancel, done: make(chan struct{})}
+	mgr.running[m.String()] = r
+	mgr.stopped.Add(1)
+	mgr.lock.Unlock()
+
+	m.SourceCluster = mgr.cluster
+	done, err := StartMapping(mctx, m, mgr.sourceCS, mgr.targetCS)
+	if err != nil {
+		cancel()
+		mgr.lock.Lock()
+		// the mapping may have been stopped, and started again, meanwhile
+		if mgr.running[m.String()] == r {
+			delete(mgr.running, m.String())
+		}
+		mgr.lock.Unlock()
+		close(r.done)
+		mgr.stopped.Done()
+		return err
+	}
+	go func() {
+		<-done
+		close(r.done)
+		mgr.stopped.Done()
+	}()
+	return nil
+}
+
+//Stop stops synchronizing the mapping. The destination objects are left untouched. The returned channel is closed once
+//the mapping has stopped, including the sync in flight if any, so that the destination objects can be deleted without
+//being written again.
+func (mgr *Manager) Stop(m Mapping) <-chan struct{} {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	r, ok := mgr.running[m.String()]
+	if !ok {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	r.cancel()
+	delete(mgr.running, m.String())
+	forgetMetrics(m)
+	return r.done
+}
+
+//Running returns whether the mapping is currently being synchronized.
+func (mgr *Manager) Running(m Mapping) bool {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	_, ok := mgr.running[m.String()]
+	return ok
+}
+
+//Wait blocks until all mappings that were started have stopped. Mappings stop when they are stopped or when the
+//context they were started with is done.
+func (mgr *Manager) Wait() {
+	mgr.stopped.Wait()
+}
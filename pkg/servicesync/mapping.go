@@ -0,0 +1,388 @@
+package servicesync
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+//DeletionPolicy decides what happens to the destination objects when the source object is deleted.
+type DeletionPolicy string
+
+const (
+	//DeletionKeep leaves the destination objects as they are.
+	DeletionKeep DeletionPolicy = "keep"
+	//DeletionDelete deletes the destination objects.
+	DeletionDelete DeletionPolicy = "delete"
+	//DeletionBlank keeps the destination service but removes all of its endpoints so clients fail fast.
+	DeletionBlank DeletionPolicy = "blank"
+)
+
+//EndpointMode decides which addresses the destination endpoints point to.
+type EndpointMode string
+
+const (
+	//EndpointModePod copies the pod addresses of the source endpoints. Pod addresses have to be routable from the
+	//destination cluster.
+	EndpointModePod EndpointMode = "pod"
+	//EndpointModeNodePort points the destination endpoints at the node ports of the source service on all source nodes.
+	//The source service has to be of type NodePort or LoadBalancer and its external traffic policy should be Cluster,
+	//as every source node is used regardless of where the pods run.
+	EndpointModeNodePort EndpointMode = "node-port"
+	//EndpointModeLoadBalancer points the destination endpoints at the load balancer ingresses of the source service.
+	//Ingresses that only have a hostname are resolved.
+	EndpointModeLoadBalancer EndpointMode = "load-balancer"
+	//EndpointModeAlias creates an ExternalName destination service without endpoints. The external name is taken from
+	//ExternalName, rendered from ExternalNameTemplate or taken from the load balancer hostname of the source service.
+	EndpointModeAlias EndpointMode = "alias"
+)
+
+//DestinationType is the type of the destination service.
+type DestinationType string
+
+const (
+	//DestinationTypeSource gives the destination service the type of the source service. A headless source results in
+	//a headless destination and an ExternalName source in an ExternalName destination.
+	DestinationTypeSource DestinationType = "Source"
+	//DestinationTypeClusterIP creates a ClusterIP destination service.
+	DestinationTypeClusterIP DestinationType = "ClusterIP"
+	//DestinationTypeHeadless creates a headless ClusterIP destination service, like Headless.
+	DestinationTypeHeadless DestinationType = "Headless"
+	//DestinationTypeNodePort creates a NodePort destination service. Node ports are allocated in the destination.
+	DestinationTypeNodePort DestinationType = "NodePort"
+	//DestinationTypeLoadBalancer creates a LoadBalancer destination service, which provisions a load balancer in the
+	//destination.
+	DestinationTypeLoadBalancer DestinationType = "LoadBalancer"
+	//DestinationTypeExternalName creates an ExternalName destination service pointing at ExternalName, or at the
+	//external name of the source.
+	DestinationTypeExternalName DestinationType = "ExternalName"
+)
+
+//SourcePolicy decides how the endpoints of the sources of a mapping are published.
+type SourcePolicy string
+
+const (
+	//SourcePolicyMerge publishes the endpoints of all sources.
+	SourcePolicyMerge SourcePolicy = "merge"
+	//SourcePolicyPriority publishes the endpoints of the first source in the order of the sources that has at least
+	//MinReadyAddresses ready addresses. A source that lost its ready addresses is only published again once it has had
+	//enough of them for FailbackDelay.
+	SourcePolicyPriority SourcePolicy = "priority"
+)
+
+//Mapping describes a single source service that is synchronized to a destination service.
+type Mapping struct {
+	//SourceCluster is the name of the source cluster. It is set by the manager running the mapping.
+	SourceCluster string `mapstructure:"-"`
+	//DestinationCluster is the name of the destination cluster of a mapping that is fanned out to several
+	//destinations. It is empty for the default destination cluster.
+	DestinationCluster string `mapstructure:"-"`
+	//MergedSource is the name of the source cluster that is synced by a mapping that merges several sources. It is empty
+	//for the mapping that writes the merged destination.
+	MergedSource         string `mapstructure:"-"`
+	SourceNamespace      string `mapstructure:"source-namespace"`
+	SourceName           string `mapstructure:"service"`
+	DestinationNamespace string `mapstructure:"destination-namespace"`
+	DestinationName      string `mapstructure:"rename-service"`
+	//OnDelete is applied when the source service or endpoints are deleted. Defaults to keep.
+	OnDelete DeletionPolicy `mapstructure:"on-delete"`
+	//Adopt allows the mapping to take over existing destination objects that servicesync does not manage.
+	Adopt bool `mapstructure:"adopt"`
+	//EndpointSlices reads the EndpointSlices of the source service and writes EndpointSlices to the destination instead
+	//of Endpoints.
+	EndpointSlices bool `mapstructure:"endpoint-slices"`
+	//IPFamilies restricts the IP families of the destination service and the addresses that are synchronized. Empty
+	//synchronizes all families.
+	IPFamilies []corev1.IPFamily `mapstructure:"ip-families"`
+	//Headless creates a headless destination service and keeps the hostnames of the endpoints, so that every endpoint
+	//can be resolved by its own DNS name in the destination cluster.
+	Headless bool `mapstructure:"headless"`
+	//EndpointMode decides which addresses the destination endpoints point to. Defaults to pod.
+	EndpointMode EndpointMode `mapstructure:"endpoint-mode"`
+	//NodeAddressType is the type of the source node addresses used in node-port mode. Defaults to InternalIP.
+	NodeAddressType corev1.NodeAddressType `mapstructure:"node-address-type"`
+	//DestinationType is the type of the destination service. Defaults to Source. Changes that cannot be applied to an
+	//existing service, such as to or from a headless service, recreate the destination service.
+	DestinationType DestinationType `mapstructure:"destination-type"`
+	//ExternalName is the external name of an ExternalName destination service. Defaults to the external name of the
+	//source service.
+	ExternalName string `mapstructure:"external-name"`
+	//ExternalNameTemplate is a Go template of the external name of the destination service in alias mode. It is
+	//rendered with the Name, Namespace and Cluster of the source service and the Hostname and IP of its first load
+	//balancer ingress.
+	ExternalNameTemplate string `mapstructure:"external-name-template"`
+	//Destinations fans the mapping out to several destination clusters instead of the default destination cluster.
+	Destinations []Destination `mapstructure:"destinations"`
+	//Sources merges the endpoints of the source service in several source clusters into the destination instead of
+	//reading the default source cluster. The destination service is synced from the first source.
+	Sources []Source `mapstructure:"sources"`
+	//SourcePolicy decides how the endpoints of the Sources are published. Defaults to merge.
+	SourcePolicy SourcePolicy `mapstructure:"source-policy"`
+	//MinReadyAddresses is how many ready addresses a source needs to be published with the priority policy. Defaults
+	//to 1.
+	MinReadyAddresses int `mapstructure:"min-ready-addresses"`
+	//FailbackDelay is how long a source that lost its ready addresses needs enough of them again before it is
+	//published instead of a source of lower priority. Defaults to 30s.
+	FailbackDelay time.Duration `mapstructure:"failback-delay"`
+	//LocalSelector selects local pods in the destination namespace whose addresses are published in the destination
+	//endpoints. The endpoints of the source are only added when fewer than FailoverThreshold local pods are ready. The
+	//destination service keeps no selector, so that its endpoints are not managed by the destination cluster.
+	LocalSelector string `mapstructure:"local-selector"`
+	//FailoverThreshold is the number of ready local pods below which the endpoints of the source are published.
+	//Defaults to 1.
+	FailoverThreshold int `mapstructure:"failover-threshold"`
+
+	// sources are the informers shared by the destinations of a fanned out mapping.
+	sources *sharedSources
+	// sourceClients are the client sets of the Sources by name, if they were created already.
+	sourceClients map[string]kubernetes.Interface
+	// local are the destination endpoints of a running mapping with a LocalSelector.
+	local *localEndpoints
+}
+
+//Destination is a destination cluster a mapping is fanned out to.
+type Destination struct {
+	Name       string `mapstructure:"name"`
+	KubeConfig string `mapstructure:"kube-config"`
+	//DestinationNamespace overrides the destination namespace of the mapping in this cluster.
+	DestinationNamespace string `mapstructure:"destination-namespace"`
+	//DestinationName overrides the destination name of the mapping in this cluster.
+	DestinationName string `mapstructure:"rename-service"`
+}
+
+//Source is a source cluster whose endpoints are merged into the destination of a mapping.
+type Source struct {
+	Name       string `mapstructure:"name"`
+	KubeConfig string `mapstructure:"kube-config"`
+}
+
+func (m Mapping) String() string {
+	if m.MergedSource != "" {
+		return fmt.Sprintf("%s:%s/%s -> %s/%s", m.MergedSource, m.SourceNamespace, m.SourceName, m.DestinationNamespace, m.DestinationName)
+	}
+	if m.DestinationCluster != "" {
+		return fmt.Sprintf("%s/%s -> %s:%s/%s", m.SourceNamespace, m.SourceName, m.DestinationCluster, m.DestinationNamespace, m.DestinationName)
+	}
+	return fmt.Sprintf("%s/%s -> %s/%s", m.SourceNamespace, m.SourceName, m.DestinationNamespace, m.DestinationName)
+}
+
+//forDestination returns the mapping to the destination cluster d.
+func (m Mapping) forDestination(d Destination) Mapping {
+	m.DestinationCluster = d.Name
+	if d.DestinationNamespace != "" {
+		m.DestinationNamespace = d.DestinationNamespace
+	}
+	if d.DestinationName != "" {
+		m.DestinationName = d.DestinationName
+	}
+	m.Destinations = nil
+	return m
+}
+
+//forSource returns the mapping that syncs the source cluster s into the merged destination.
+func (m Mapping) forSource(s Source) Mapping {
+	m.MergedSource = s.Name
+	m.Sources = nil
+	return m
+}
+
+func (m *Mapping) setDefaults() {
+	if m.DestinationName == "" {
+		m.DestinationName = m.SourceName
+	}
+	if m.OnDelete == "" {
+		m.OnDelete = DeletionKeep
+	}
+	if m.EndpointMode == EndpointModeNodePort && m.NodeAddressType == "" {
+		m.NodeAddressType = corev1.NodeInternalIP
+	}
+	if m.DestinationType == "" {
+		m.DestinationType = DestinationTypeSource
+	}
+	if m.Headless && m.DestinationType == DestinationTypeSource {
+		m.DestinationType = DestinationTypeHeadless
+	}
+	if m.DestinationType == DestinationTypeHeadless {
+		m.Headless = true
+	}
+	if m.LocalSelector != "" && m.FailoverThreshold == 0 {
+		m.FailoverThreshold = 1
+	}
+	if len(m.Sources) > 0 && m.SourcePolicy == "" {
+		m.SourcePolicy = SourcePolicyMerge
+	}
+	if m.SourcePolicy == SourcePolicyPriority {
+		if m.MinReadyAddresses == 0 {
+			m.MinReadyAddresses = 1
+		}
+		if m.FailbackDelay == 0 {
+			m.FailbackDelay = defaultFailbackDelay
+		}
+	}
+}
+
+func (m Mapping) validate() error {
+	if m.SourceName == "" {
+		return fmt.Errorf("mapping %s: service not set", m)
+	}
+	if m.SourceNamespace == "" {
+		return fmt.Errorf("mapping %s: source-namespace not set", m)
+	}
+	if m.DestinationNamespace == "" {
+		return fmt.Errorf("mapping %s: destination-namespace not set", m)
+	}
+	switch m.OnDelete {
+	case DeletionKeep, DeletionDelete, DeletionBlank:
+	default:
+		return fmt.Errorf("mapping %s: unknown on-delete policy %q", m, m.OnDelete)
+	}
+	switch m.EndpointMode {
+	case "", EndpointModePod:
+	case EndpointModeAlias:
+		if m.EndpointSlices {
+			return fmt.Errorf("mapping %s: endpoint-mode %s does not support endpoint-slices", m, m.EndpointMode)
+		}
+		if m.DestinationType != "" && m.DestinationType != DestinationTypeSource && m.DestinationType != DestinationTypeExternalName {
+			return fmt.Errorf("mapping %s: endpoint-mode %s requires destination-type %s, not %s", m, m.EndpointMode, DestinationTypeExternalName, m.DestinationType)
+		}
+		if _, err := template.New("external-name").Parse(m.ExternalNameTemplate); err != nil {
+			return fmt.Errorf("mapping %s: invalid external-name-template: %s", m, err)
+		}
+	case EndpointModeLoadBalancer:
+		if m.EndpointSlices {
+			return fmt.Errorf("mapping %s: endpoint-mode %s does not support endpoint-slices", m, m.EndpointMode)
+		}
+	case EndpointModeNodePort:
+		if m.EndpointSlices {
+			return fmt.Errorf("mapping %s: endpoint-mode %s does not support endpoint-slices", m, m.EndpointMode)
+		}
+		if m.NodeAddressType != corev1.NodeInternalIP && m.NodeAddressType != corev1.NodeExternalIP {
+			return fmt.Errorf("mapping %s: node-address-type must be %s or %s, not %q", m, corev1.NodeInternalIP, corev1.NodeExternalIP, m.NodeAddressType)
+		}
+	default:
+		return fmt.Errorf("mapping %s: unknown endpoint-mode %q", m, m.EndpointMode)
+	}
+	switch m.DestinationType {
+	case "", DestinationTypeSource, DestinationTypeClusterIP, DestinationTypeHeadless, DestinationTypeNodePort, DestinationTypeLoadBalancer, DestinationTypeExternalName:
+	default:
+		return fmt.Errorf("mapping %s: unknown destination-type %q", m, m.DestinationType)
+	}
+	if m.Headless && m.DestinationType != "" && m.DestinationType != DestinationTypeSource && m.DestinationType != DestinationTypeHeadless {
+		return fmt.Errorf("mapping %s: headless requires destination-type %s, not %s", m, DestinationTypeHeadless, m.DestinationType)
+	}
+	for _, f := range m.IPFamilies {
+		if f != corev1.IPv4Protocol && f != corev1.IPv6Protocol {
+			return fmt.Errorf("mapping %s: unknown IP family %q", m, f)
+		}
+	}
+	names := map[string]bool{}
+	for _, d := range m.Destinations {
+		if d.Name == "" || d.KubeConfig == "" {
+			return fmt.Errorf("mapping %s: destinations need a name and a kube-config", m)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("mapping %s: destination %s is listed twice", m, d.Name)
+		}
+		names[d.Name] = true
+	}
+	if len(m.Sources) > 0 {
+		if len(m.Destinations) > 0 {
+			return fmt.Errorf("mapping %s: sources cannot be merged into several destinations", m)
+		}
+		if m.EndpointSlices || (m.EndpointMode != "" && m.EndpointMode != EndpointModePod) {
+			return fmt.Errorf("mapping %s: sources can only be merged into endpoints in endpoint-mode %s", m, EndpointModePod)
+		}
+	}
+	if m.LocalSelector != "" {
+		if _, err := labels.Parse(m.LocalSelector); err != nil {
+			return fmt.Errorf("mapping %s: invalid local-selector: %s", m, err)
+		}
+		if len(m.Sources) > 0 || m.EndpointSlices || (m.EndpointMode != "" && m.EndpointMode != EndpointModePod) {
+			return fmt.Errorf("mapping %s: local-selector requires endpoint-mode %s without sources and endpoint-slices", m, EndpointModePod)
+		}
+	}
+	if m.FailoverThreshold < 0 {
+		return fmt.Errorf("mapping %s: failover-threshold must not be negative", m)
+	}
+	switch m.SourcePolicy {
+	case "", SourcePolicyMerge:
+	case SourcePolicyPriority:
+		if len(m.Sources) == 0 {
+			return fmt.Errorf("mapping %s: source-policy %s requires sources", m, m.SourcePolicy)
+		}
+	default:
+		return fmt.Errorf("mapping %s: unknown source-policy %q", m, m.SourcePolicy)
+	}
+	if m.MinReadyAddresses < 0 || m.FailbackDelay < 0 {
+		return fmt.Errorf("mapping %s: min-ready-addresses and failback-delay must not be negative", m)
+	}
+	names = map[string]bool{}
+	for _, s := range m.Sources {
+		if s.Name == "" || s.KubeConfig == "" {
+			return fmt.Errorf("mapping %s: sources need a name and a kube-config", m)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("mapping %s: source %s is listed twice", m, s.Name)
+		}
+		names[s.Name] = true
+	}
+	return nil
+}
+
+//MappingsFromConfig reads the list of mappings under the "mappings" key. If no list is configured but a top level
+//service is set, a single mapping is built from the service, rename-service, source-namespace,
+//destination-namespace, destinations and sources keys.
+func MappingsFromConfig(v *viper.Viper) ([]Mapping, error) {
+	var mappings []Mapping
+	if v.IsSet("mappings") {
+		if err := v.UnmarshalKey("mappings", &mappings); err != nil {
+			return nil, fmt.Errorf("could not read mappings: %s", err)
+		}
+	} else if v.IsSet("service") {
+		mappings = append(mappings, Mapping{
+			SourceNamespace:      v.GetString("source-namespace"),
+			SourceName:           v.GetString("service"),
+			DestinationNamespace: v.GetString("destination-namespace"),
+			DestinationName:      v.GetString("rename-service"),
+			OnDelete:             DeletionPolicy(v.GetString("on-delete")),
+			Adopt:                v.GetBool("adopt"),
+			EndpointSlices:       v.GetBool("endpoint-slices"),
+			IPFamilies:           ipFamilies(v.GetStringSlice("ip-families")),
+			Headless:             v.GetBool("headless"),
+			EndpointMode:         EndpointMode(v.GetString("endpoint-mode")),
+			NodeAddressType:      corev1.NodeAddressType(v.GetString("node-address-type")),
+			DestinationType:      DestinationType(v.GetString("destination-type")),
+			ExternalName:         v.GetString("external-name"),
+			ExternalNameTemplate: v.GetString("external-name-template"),
+			LocalSelector:        v.GetString("local-selector"),
+			FailoverThreshold:    v.GetInt("failover-threshold"),
+			SourcePolicy:         SourcePolicy(v.GetString("source-policy")),
+			MinReadyAddresses:    v.GetInt("min-ready-addresses"),
+			FailbackDelay:        v.GetDuration("failback-delay"),
+		})
+		if err := v.UnmarshalKey("destinations", &mappings[0].Destinations); err != nil {
+			return nil, fmt.Errorf("could not read destinations: %s", err)
+		}
+		if err := v.UnmarshalKey("sources", &mappings[0].Sources); err != nil {
+			return nil, fmt.Errorf("could not read sources: %s", err)
+		}
+	}
+	for i := range mappings {
+		mappings[i].setDefaults()
+	}
+	return mappings, nil
+}
+
+func ipFamilies(families []string) []corev1.IPFamily {
+	var converted []corev1.IPFamily
+	for _, f := range families {
+		converted = append(converted, corev1.IPFamily(f))
+	}
+	return converted
+}
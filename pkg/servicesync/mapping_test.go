@@ -0,0 +1,141 @@
+package servicesync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMappingsFromConfigList(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	config := []byte(`
+mappings:
+  - service: fooService
+    source-namespace: foo
+    destination-namespace: bar
+    rename-service: barService
+  - service: bazService
+    source-namespace: baz
+    destination-namespace: bar
+`)
+	if err := v.ReadConfig(bytes.NewBuffer(config)); err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := MappingsFromConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 {
+		t.Fatalf("expected 2 mappings but found %d", len(mappings))
+	}
+	if mappings[0].DestinationName != "barService" {
+		t.Errorf("rename-service was not read: %s", mappings[0].DestinationName)
+	}
+	if mappings[1].DestinationName != "bazService" {
+		t.Errorf("rename-service should default to service but found %s", mappings[1].DestinationName)
+	}
+}
+
+func TestMappingsFromConfigSingle(t *testing.T) {
+	v := viper.New()
+	v.Set("service", "fooService")
+	v.Set("source-namespace", "foo")
+	v.Set("destination-namespace", "bar")
+	mappings, err := MappingsFromConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 1 {
+		t.Fatalf("expected 1 mapping but found %d", len(mappings))
+	}
+	if m := mappings[0]; m.SourceName != "fooService" || m.DestinationName != "fooService" || m.DestinationNamespace != "bar" {
+		t.Errorf("mapping was not read from top level keys: %s", m)
+	}
+}
+
+func TestStartMappingInvalid(t *testing.T) {
+	ctx := context.Background()
+	sourceCS := fake.NewSimpleClientset()
+	targetCS := fake.NewSimpleClientset()
+	if _, err := StartMapping(ctx, Mapping{SourceName: "fooService"}, sourceCS, targetCS); err == nil {
+		t.Error("mapping without namespaces should not start")
+	}
+	if _, err := StartMapping(ctx, Mapping{SourceNamespace: "foo", SourceName: "missing", DestinationNamespace: "bar", DestinationName: "missing"}, sourceCS, targetCS); err == nil {
+		t.Error("mapping with missing source service should not start")
+	}
+}
+
+func TestStartMapping(t *testing.T) {
+	ctx := context.Background()
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port: 81,
+				},
+			},
+		},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	})
+	targetCS := fake.NewSimpleClientset()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService"}
+	if _, err := StartMapping(ctx, m, sourceCS, targetCS); err != nil {
+		t.Fatal(err)
+	}
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Spec.Ports[0].Port != 81 {
+		t.Errorf("service was not synced on start: found port %d but should be 81", s.Spec.Ports[0].Port)
+	}
+}
+
+func TestManagerWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	})
+	mgr := NewManager("source", sourceCS, fake.NewSimpleClientset())
+	if err := mgr.Start(ctx, Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		mgr.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * sleepLength):
+		t.Fatal("mappings did not stop")
+	}
+	if err := mgr.Start(ctx, Mapping{SourceNamespace: "foo", SourceName: "other", DestinationNamespace: "bar"}); err == nil {
+		t.Error("expected starting a mapping after shutdown to fail")
+	}
+}
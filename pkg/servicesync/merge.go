@@ -0,0 +1,278 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+//StartMerge starts a mapping that merges the endpoints of its source service in each of its source clusters, with the
+//client set in sources under the name of the source, into one destination. The destination service is synced from the
+//first source. Every source is watched independently, and the addresses of a source that cannot be reached are
+//withdrawn from the destination until it can be reached again, without affecting the other sources. With the priority
+//source policy only the endpoints of one source are published, see SourcePolicyPriority. It returns once the initial
+//sync of the service from the first source and of the endpoints of the sources that can be read succeeded, and fails if
+//none of the sources can be read. The syncers are then started in the background and retried with backoff should they
+//fail to start. The returned channel is closed once ctx is done and all sources have stopped.
+func StartMerge(ctx context.Context, m Mapping, sources map[string]kubernetes.Interface, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	m.setDefaults()
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if len(m.Sources) == 0 {
+		return nil, fmt.Errorf("mapping %s: no sources to merge", m)
+	}
+	for _, s := range m.Sources {
+		if sources[s.Name] == nil {
+			return nil, fmt.Errorf("mapping %s: no client set for source %s", m, s.Name)
+		}
+	}
+	m.sourceClients = sources
+	if err := EnsureService(ctx, m, targetCS); err != nil {
+		return nil, err
+	}
+	if err := EnsureEndpoints(ctx, m, targetCS); err != nil {
+		return nil, err
+	}
+	if err := GetAndUpdateService(ctx, m, sources[m.Sources[0].Name], targetCS); err != nil {
+		return nil, err
+	}
+	merge := newEndpointsMerge(m, targetCS)
+	sourceErrs, err := merge.getAndUpdate(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+	if len(sourceErrs) == len(m.Sources) {
+		return nil, fmt.Errorf("mapping %s: none of the sources can be read", m)
+	}
+	var stopped []<-chan struct{}
+	// the syncers wait for their source to be listed, which does not happen while it is unreachable
+	start := func(name string, run func(ctx context.Context) (<-chan struct{}, error)) {
+		done := make(chan struct{})
+		stopped = append(stopped, done)
+		go func() {
+			defer close(done)
+			runWithRetry(ctx, "syncing the "+name+" of mapping "+m.String(), run)
+		}()
+	}
+	start("service", func(ctx context.Context) (<-chan struct{}, error) {
+		return SyncService(ctx, m, sources[m.Sources[0].Name], targetCS)
+	})
+	for _, s := range m.Sources {
+		sm := m.forSource(s)
+		sourceCS := sources[s.Name]
+		start("endpoints of source "+s.Name, func(ctx context.Context) (<-chan struct{}, error) {
+			return syncMergedEndpoints(ctx, sm, merge, sourceCS)
+		})
+	}
+	return joined(stopped...), nil
+}
+
+//syncMergedEndpoints keeps the endpoints of the source cluster m.MergedSource in the merged destination endpoints until
+//ctx is done. It returns once the source endpoints have been listed.
+func syncMergedEndpoints(ctx context.Context, m Mapping, merge *endpointsMerge, sourceCS kubernetes.Interface) (<-chan struct{}, error) {
+	lw := &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			return sourceCS.CoreV1().Endpoints(m.SourceNamespace).List(ctx, withName(o, m.SourceName))
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			return sourceCS.CoreV1().Endpoints(m.SourceNamespace).Watch(ctx, withName(o, m.SourceName))
+		},
+	}
+	// unreachable is 1 from a failure to list or watch the source until it is watched again. The informer keeps the
+	// last known source endpoints meanwhile, which may be stale.
+	var unreachable int32
+	s := newSourceSyncer("endpoints", m, lw, &corev1.Endpoints{}, func(ctx context.Context, obj interface{}) error {
+		if atomic.LoadInt32(&unreachable) == 1 {
+			return merge.update(ctx, m.MergedSource, nil)
+		}
+		return merge.update(ctx, m.MergedSource, obj.(*corev1.Endpoints))
+	}, func(ctx context.Context) error {
+		return merge.update(ctx, m.MergedSource, nil)
+	})
+	s.unreachable = func() {
+		if atomic.SwapInt32(&unreachable, 1) == 0 {
+			logrus.Warnf("source cluster %s of mapping %s is unreachable, withdrawing its endpoints", m.MergedSource, m)
+			// a source that is unreachable from the start is not synced until it can be listed
+			merge.lock.Lock()
+			merge.reported[m.MergedSource] = true
+			merge.lock.Unlock()
+			s.resync()
+		}
+	}
+	s.reachable = func() {
+		if atomic.SwapInt32(&unreachable, 0) == 1 {
+			logrus.Infof("source cluster %s of mapping %s is reachable again", m.MergedSource, m)
+			s.resync()
+		}
+	}
+	merge.lock.Lock()
+	merge.resyncs[m.MergedSource] = s.resync
+	merge.lock.Unlock()
+	done, err := s.run(ctx)
+	if err != nil {
+		logrus.Errorf("error while establishing a watch connection from source: %s", err)
+		return nil, err
+	}
+	return done, nil
+}
+
+//endpointsMerge is the state of the destination endpoints of a mapping that merges several sources.
+type endpointsMerge struct {
+	mapping  Mapping
+	targetCS kubernetes.Interface
+	lock     sync.Mutex
+	// endpoints are the endpoints of each source cluster, nil for a source without endpoints or one that cannot be
+	// reached.
+	endpoints map[string]*corev1.Endpoints
+	// recreate is true once the destination endpoints were not found until they were created again.
+	recreate bool
+	// reported holds the sources that were synced or found unreachable at least once.
+	reported map[string]bool
+	// active is the source whose endpoints are published with the priority policy, see prioritySource.
+	active string
+	// eligibleSince is since when each source has enough ready addresses to be published with the priority policy.
+	eligibleSince map[string]time.Time
+	// degraded holds the sources that lost enough ready addresses after they had them.
+	degraded map[string]bool
+	// resyncs sync each source again, to publish a source once its failback delay has passed.
+	resyncs  map[string]func()
+	failback *time.Timer
+}
+
+func newEndpointsMerge(m Mapping, targetCS kubernetes.Interface) *endpointsMerge {
+	return &endpointsMerge{
+		mapping:       m,
+		targetCS:      targetCS,
+		endpoints:     map[string]*corev1.Endpoints{},
+		reported:      map[string]bool{},
+		eligibleSince: map[string]time.Time{},
+		degraded:      map[string]bool{},
+		resyncs:       map[string]func(){},
+	}
+}
+
+//update sets the endpoints of the source cluster and writes the published endpoints to the destination.
+func (e *endpointsMerge) update(ctx context.Context, source string, endpoints *corev1.Endpoints) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.endpoints[source] = endpoints
+	if e.recreate {
+		if err := EnsureEndpoints(ctx, e.mapping, e.targetCS); err != nil {
+			return err
+		}
+	}
+	published := e.published(time.Now())
+	e.reported[source] = true
+	err := UpdateEndpoints(ctx, published, e.mapping, e.targetCS)
+	// the destination may have been deleted along with a recreated destination service
+	e.recreate = k8serror.IsNotFound(err)
+	return err
+}
+
+//published returns the endpoints to publish, which are the merged endpoints of all sources or the endpoints of the
+//selected source with the priority policy.
+func (e *endpointsMerge) published(now time.Time) *corev1.Endpoints {
+	if e.mapping.SourcePolicy == SourcePolicyPriority {
+		if source := e.prioritySource(now); source != e.active {
+			e.switchSource(source)
+		}
+		return mergeEndpoints([]*corev1.Endpoints{e.endpoints[e.active]})
+	}
+	var all []*corev1.Endpoints
+	for _, s := range e.mapping.Sources {
+		all = append(all, e.endpoints[s.Name])
+	}
+	return mergeEndpoints(all)
+}
+
+//mergeEndpoints returns endpoints with the subsets of all endpoints. Missing endpoints are skipped.
+func mergeEndpoints(all []*corev1.Endpoints) *corev1.Endpoints {
+	merged := &corev1.Endpoints{}
+	for _, e := range all {
+		if e != nil {
+			merged.Subsets = append(merged.Subsets, e.Subsets...)
+		}
+	}
+	return merged
+}
+
+//getAndUpdateMergedEndpoints does a one time sync of the endpoints of the sources of the mapping. The addresses of
+//sources that cannot be read are left out and the first error reading a source is returned after the update.
+func getAndUpdateMergedEndpoints(ctx context.Context, m Mapping, targetCS kubernetes.Interface) error {
+	sources, err := sourceClientSets(m)
+	if err != nil {
+		return err
+	}
+	sourceErrs, err := newEndpointsMerge(m, targetCS).getAndUpdate(ctx, sources)
+	if err != nil {
+		return err
+	}
+	for _, s := range m.Sources {
+		if err := sourceErrs[s.Name]; err != nil {
+			return fmt.Errorf("source %s: %s", s.Name, err)
+		}
+	}
+	return nil
+}
+
+//getAndUpdate reads the endpoints of every source and writes the published endpoints to the destination. The addresses
+//of sources that cannot be read are left out, and the errors reading them are returned by source.
+func (e *endpointsMerge) getAndUpdate(ctx context.Context, sources map[string]kubernetes.Interface) (map[string]error, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	m := e.mapping
+	sourceErrs := map[string]error{}
+	for _, s := range m.Sources {
+		endpoints, err := sources[s.Name].CoreV1().Endpoints(m.SourceNamespace).Get(ctx, m.SourceName, metav1.GetOptions{})
+		switch {
+		case k8serror.IsNotFound(err):
+			e.endpoints[s.Name] = nil
+		case err != nil:
+			logrus.Errorf("error while getting endpoints definition from source %s, leaving out its addresses: %s", s.Name, err)
+			sourceErrs[s.Name] = err
+			e.endpoints[s.Name] = nil
+		default:
+			e.endpoints[s.Name] = endpoints
+		}
+	}
+	published := e.published(time.Now())
+	// every source was synced or found unreachable, so later switches are recorded
+	for _, s := range m.Sources {
+		e.reported[s.Name] = true
+	}
+	return sourceErrs, UpdateEndpoints(ctx, published, m, e.targetCS)
+}
+
+//sourceClientSets returns a client set for every source cluster of a mapping that merges several sources.
+func sourceClientSets(m Mapping) (map[string]kubernetes.Interface, error) {
+	if m.sourceClients != nil {
+		return m.sourceClients, nil
+	}
+	sources := map[string]kubernetes.Interface{}
+	for _, s := range m.Sources {
+		config, err := clientcmd.BuildConfigFromFlags("", s.KubeConfig)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		sources[s.Name] = cs
+	}
+	return sources, nil
+}
@@ -0,0 +1,227 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func sourceEndpoints(ip string) *corev1.Endpoints {
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: ip}},
+			Ports:     []corev1.EndpointPort{{Port: 80}},
+		}},
+	}
+}
+
+//unreachableSource is a source cluster whose endpoints can be made unreachable.
+type unreachableSource struct {
+	*fake.Clientset
+	lock    sync.Mutex
+	down    bool
+	watches []*watch.FakeWatcher
+}
+
+func newUnreachableSource(objects ...runtime.Object) *unreachableSource {
+	s := &unreachableSource{Clientset: fake.NewSimpleClientset(objects...)}
+	s.PrependReactor("*", "endpoints", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.down {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		return false, nil, nil
+	})
+	s.PrependWatchReactor("endpoints", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.down {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		w := watch.NewFake()
+		s.watches = append(s.watches, w)
+		return true, w, nil
+	})
+	return s
+}
+
+func (s *unreachableSource) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+	if down {
+		for _, w := range s.watches {
+			w.Stop()
+		}
+		s.watches = nil
+	}
+}
+
+func TestMergeEndpoints(t *testing.T) {
+	merged := mergeEndpoints([]*corev1.Endpoints{sourceEndpoints("1.1.1.1"), nil, sourceEndpoints("3.3.3.3")})
+	if len(merged.Subsets) != 2 || merged.Subsets[0].Addresses[0].IP != "1.1.1.1" || merged.Subsets[1].Addresses[0].IP != "3.3.3.3" {
+		t.Errorf("expected the subsets of both endpoints, got %v", merged.Subsets)
+	}
+}
+
+func TestStartMerge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	east := fake.NewSimpleClientset(sourceEndpoints("1.1.1.1"), &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	})
+	west := newUnreachableSource(sourceEndpoints("2.2.2.2"))
+	north := fake.NewSimpleClientset()
+	targetCS := fake.NewSimpleClientset()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", Sources: []Source{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "west", KubeConfig: "west.yaml"},
+		{Name: "north", KubeConfig: "north.yaml"},
+	}}
+	done, err := StartMerge(ctx, m, map[string]kubernetes.Interface{"east": east, "west": west, "north": north}, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIPs := func(want ...string) {
+		t.Helper()
+		e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "fooService", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ips []string
+		for _, s := range e.Subsets {
+			for _, a := range s.Addresses {
+				ips = append(ips, a.IP)
+			}
+		}
+		sort.Strings(ips)
+		if !reflect.DeepEqual(ips, want) {
+			t.Errorf("expected addresses %v, got %v", want, ips)
+		}
+	}
+	time.Sleep(sleepLength)
+	if _, err := targetCS.CoreV1().Services("bar").Get(ctx, "fooService", metav1.GetOptions{}); err != nil {
+		t.Errorf("target service was not synced from the first source: %s", err)
+	}
+	expectIPs("1.1.1.1", "2.2.2.2")
+
+	// a source that is added later is merged as well
+	if _, err := north.CoreV1().Endpoints("foo").Create(ctx, sourceEndpoints("3.3.3.3"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectIPs("1.1.1.1", "2.2.2.2", "3.3.3.3")
+
+	// only the addresses of an unreachable source are withdrawn
+	west.setDown(true)
+	time.Sleep(2 * sleepLength)
+	expectIPs("1.1.1.1", "3.3.3.3")
+	if _, err := east.CoreV1().Endpoints("foo").Update(ctx, sourceEndpoints("1.1.1.2"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectIPs("1.1.1.2", "3.3.3.3")
+
+	// and published again once it can be reached
+	west.setDown(false)
+	time.Sleep(4 * sleepLength)
+	expectIPs("1.1.1.2", "2.2.2.2", "3.3.3.3")
+	cancel()
+	<-done
+}
+
+func TestStartMergeInitialSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	east := fake.NewSimpleClientset(sourceEndpoints("1.1.1.1"), &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}},
+	})
+	west := newUnreachableSource(sourceEndpoints("2.2.2.2"))
+	west.setDown(true)
+	targetCS := fake.NewSimpleClientset()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", Sources: []Source{
+		{Name: "west", KubeConfig: "west.yaml"},
+		{Name: "east", KubeConfig: "east.yaml"},
+	}}
+	// the service is synced from the first source, which cannot be read
+	if _, err := StartMerge(ctx, m, map[string]kubernetes.Interface{"east": east, "west": west}, targetCS); err == nil {
+		t.Fatal("expected the mapping not to start while its first source cannot be read")
+	}
+	m.Sources[0], m.Sources[1] = m.Sources[1], m.Sources[0]
+	done, err := StartMerge(ctx, m, map[string]kubernetes.Interface{"east": east, "west": west}, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reachable source is published once the mapping started
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "fooService", metav1.GetOptions{})
+	if err != nil || s.Spec.Ports[0].Port != 8080 {
+		t.Errorf("expected the service of the first source, got %v, %v", s, err)
+	}
+	e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "fooService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Subsets) != 1 || e.Subsets[0].Addresses[0].IP != "1.1.1.1" {
+		t.Errorf("expected the addresses of the reachable source, got %v", e.Subsets)
+	}
+	cancel()
+	<-done
+}
+
+func TestSyncMappingMerged(t *testing.T) {
+	ctx := context.Background()
+	east := fake.NewSimpleClientset(sourceEndpoints("1.1.1.1"), &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	})
+	west := newUnreachableSource(sourceEndpoints("2.2.2.2"))
+	west.setDown(true)
+	targetCS := fake.NewSimpleClientset()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", Sources: []Source{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "west", KubeConfig: "west.yaml"},
+	}}
+	m.sourceClients = map[string]kubernetes.Interface{"east": east, "west": west}
+	if err := syncMapping(ctx, m, nil, targetCS); err == nil {
+		t.Error("expected an error for the unreachable source")
+	}
+	e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "fooService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Subsets) != 1 || e.Subsets[0].Addresses[0].IP != "1.1.1.1" {
+		t.Errorf("expected the addresses of the reachable source, got %v", e.Subsets)
+	}
+}
+
+func TestValidateSources(t *testing.T) {
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", Sources: []Source{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "east", KubeConfig: "west.yaml"},
+	}}
+	if err := m.validate(); err == nil {
+		t.Error("expected duplicate sources to be rejected")
+	}
+	m.Sources = m.Sources[:1]
+	m.EndpointMode = EndpointModeNodePort
+	m.NodeAddressType = corev1.NodeInternalIP
+	if err := m.validate(); err == nil {
+		t.Error("expected merged sources in node-port mode to be rejected")
+	}
+}
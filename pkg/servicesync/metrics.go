@@ -0,0 +1,122 @@
+package servicesync
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	syncTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicesync",
+		Name:      "sync_total",
+		Help:      "Number of updates of destination objects by mapping, kind and result.",
+	}, []string{"mapping", "kind", "result"})
+	lastSuccessfulSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "servicesync",
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last successful update of a destination object by mapping and kind.",
+	}, []string{"mapping", "kind"})
+	propagationLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicesync",
+		Name:      "propagation_latency_seconds",
+		Help:      "Time from observing a change of a source object until the destination object was updated.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"mapping", "kind"})
+	watchRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicesync",
+		Name:      "watch_restarts_total",
+		Help:      "Number of times the watch of a source object failed and was re-established.",
+	}, []string{"mapping", "kind"})
+	endpointAddresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "servicesync",
+		Name:      "endpoint_addresses",
+		Help:      "Number of addresses of the destination endpoints by mapping and readiness.",
+	}, []string{"mapping", "state"})
+	sourceSwitches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicesync",
+		Name:      "source_switches_total",
+		Help:      "Number of switches of the published source of a mapping with the priority source policy by the source switched to.",
+	}, []string{"mapping", "source"})
+)
+
+//metricKinds holds every kind the series of a mapping were recorded under, so that they are all removed along with it.
+var metricKinds sync.Map
+
+//metricKind notes kind as a kind of the series of the mappings and returns it.
+func metricKind(kind string) string {
+	metricKinds.Store(kind, true)
+	return kind
+}
+
+func init() {
+	prometheus.MustRegister(syncTotal, lastSuccessfulSync, propagationLatency, watchRestarts, endpointAddresses, sourceSwitches)
+}
+
+//recordSync counts the result of updating a destination object of the mapping.
+func recordSync(m Mapping, kind string, err error) {
+	metricKind(kind)
+	if err != nil {
+		syncTotal.WithLabelValues(m.String(), kind, resultFailure).Inc()
+		return
+	}
+	syncTotal.WithLabelValues(m.String(), kind, resultSuccess).Inc()
+	lastSuccessfulSync.WithLabelValues(m.String(), kind).SetToCurrentTime()
+}
+
+//observePropagation records how long it took to propagate a source change observed at since.
+func observePropagation(m Mapping, kind string, since time.Time) {
+	propagationLatency.WithLabelValues(m.String(), kind).Observe(time.Since(since).Seconds())
+}
+
+//recordEndpointAddresses sets the number of ready and not ready addresses of the destination endpoints.
+func recordEndpointAddresses(m Mapping, ready, notReady int) {
+	endpointAddresses.WithLabelValues(m.String(), "ready").Set(float64(ready))
+	endpointAddresses.WithLabelValues(m.String(), "not_ready").Set(float64(notReady))
+}
+
+//recordSourceSwitch counts a switch of the published source of the mapping to source.
+func recordSourceSwitch(m Mapping, source string) {
+	sourceSwitches.WithLabelValues(m.String(), source).Inc()
+}
+
+//forgetMetrics removes the series of a mapping that is no longer synchronized.
+func forgetMetrics(m Mapping) {
+	metricKinds.Range(func(key, _ interface{}) bool {
+		kind := key.(string)
+		syncTotal.DeleteLabelValues(m.String(), kind, resultSuccess)
+		syncTotal.DeleteLabelValues(m.String(), kind, resultFailure)
+		lastSuccessfulSync.DeleteLabelValues(m.String(), kind)
+		propagationLatency.DeleteLabelValues(m.String(), kind)
+		watchRestarts.DeleteLabelValues(m.String(), kind)
+		return true
+	})
+	endpointAddresses.DeleteLabelValues(m.String(), "ready")
+	endpointAddresses.DeleteLabelValues(m.String(), "not_ready")
+}
+
+//ServeMetrics exposes the metrics on /metrics of metrics-address. An empty address disables the endpoint.
+func ServeMetrics(v *viper.Viper) {
+	addr := v.GetString("metrics-address")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		logrus.Infof("serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logrus.Fatalf("could not serve metrics on %s: %s", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSyncEndpointsMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "metrics", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", OnDelete: DeletionKeep}
+	sourceCS := fake.NewSimpleClientset(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m.SourceName,
+			Namespace: m.SourceNamespace,
+		},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses:         []corev1.EndpointAddress{{IP: "1.2.3.4"}, {IP: "1.2.3.5"}},
+				NotReadyAddresses: []corev1.EndpointAddress{{IP: "1.2.3.6"}},
+			},
+		},
+	})
+	targetCS := fake.NewSimpleClientset()
+	if _, err := SyncEndpoints(ctx, m, sourceCS, targetCS); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+
+	if v := testutil.ToFloat64(syncTotal.WithLabelValues(m.String(), "endpoints", resultSuccess)); v != 1 {
+		t.Errorf("expected 1 successful sync, got %v", v)
+	}
+	if v := testutil.ToFloat64(lastSuccessfulSync.WithLabelValues(m.String(), "endpoints")); v == 0 {
+		t.Errorf("last successful sync was not recorded")
+	}
+	if v := testutil.ToFloat64(endpointAddresses.WithLabelValues(m.String(), "ready")); v != 2 {
+		t.Errorf("expected 2 ready addresses, got %v", v)
+	}
+	if v := testutil.ToFloat64(endpointAddresses.WithLabelValues(m.String(), "not_ready")); v != 1 {
+		t.Errorf("expected 1 not ready address, got %v", v)
+	}
+	if n := testutil.CollectAndCount(propagationLatency); n == 0 {
+		t.Errorf("propagation latency was not observed")
+	}
+
+	forgetMetrics(m)
+	if v := testutil.ToFloat64(syncTotal.WithLabelValues(m.String(), "endpoints", resultSuccess)); v != 0 {
+		t.Errorf("expected metrics of a stopped mapping to be removed, got %v", v)
+	}
+}
+
+func TestUpdateServiceFailureMetrics(t *testing.T) {
+	m := Mapping{SourceNamespace: "metrics", SourceName: "missing", DestinationNamespace: "bar", DestinationName: "missing"}
+	failures := syncTotal.WithLabelValues(m.String(), "service", resultFailure)
+	before := testutil.ToFloat64(failures)
+	// the target service does not exist
+	if err := UpdateService(context.Background(), &corev1.Service{}, m, fake.NewSimpleClientset()); err == nil {
+		t.Fatal("expected error")
+	}
+	if v := testutil.ToFloat64(failures) - before; v != 1 {
+		t.Errorf("expected 1 failed sync, got %v", v)
+	}
+}
+
+func TestForgetMetricsSyncerKinds(t *testing.T) {
+	m := Mapping{SourceNamespace: "metrics", SourceName: "forget", DestinationNamespace: "bar", DestinationName: "forget"}
+	s := newAggregateSourceSyncer("local-pods", m, labels.Everything(), &cache.ListWatch{}, &corev1.Pod{}, nil, nil)
+	watchRestarts.WithLabelValues(m.String(), s.kind).Inc()
+	forgetMetrics(m)
+	if v := testutil.ToFloat64(watchRestarts.WithLabelValues(m.String(), s.kind)); v != 0 {
+		t.Errorf("expected the watch restarts of the %s syncer to be removed, got %v", s.kind, v)
+	}
+}
@@ -0,0 +1,185 @@
+package servicesync
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+//GetAndUpdateNodePortEndpoints does a one time sync of the target endpoints from the node ports of the source service
+//and the addresses of the source nodes.
+func GetAndUpdateNodePortEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	s, err := sourceCS.CoreV1().Services(m.SourceNamespace).Get(ctx, m.SourceName, metav1.GetOptions{})
+	if err != nil {
+		logrus.Errorf("error while getting service definition from source: %s", err)
+		return err
+	}
+	list, err := sourceCS.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logrus.Errorf("error while listing nodes of source: %s", err)
+		return err
+	}
+	nodes := make([]*corev1.Node, 0, len(list.Items))
+	for i := range list.Items {
+		nodes = append(nodes, &list.Items[i])
+	}
+	return UpdateEndpoints(ctx, nodePortEndpoints(s, nodes, m), m, targetCS)
+}
+
+//SyncNodePortEndpoints keeps the target endpoints pointed at the node ports of the source service on all source nodes
+//until ctx is done. The endpoints follow changes of the source service as well as nodes that are added, removed or
+//change their readiness. A deleted source service is handled according to the OnDelete policy of the mapping. The
+//returned channel is closed once ctx is done and the syncs in flight, if any, have completed.
+func SyncNodePortEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	// both syncers write the same target endpoints from the state of both informers
+	var lock sync.Mutex
+	var services, nodes *sourceSyncer
+	// added is true until the source has been synced and again once it was deleted, see SyncEndpoints.
+	added := true
+	update := func(ctx context.Context) error {
+		lock.Lock()
+		defer lock.Unlock()
+		obj, exists, err := services.get(m.SourceNamespace + "/" + m.SourceName)
+		if err != nil || !exists {
+			// the deletion is handled by the service syncer
+			return err
+		}
+		var sourceNodes []*corev1.Node
+		objs, _, _ := nodes.get("")
+		for _, n := range objs.([]interface{}) {
+			sourceNodes = append(sourceNodes, n.(*corev1.Node))
+		}
+		if added {
+			if err := EnsureEndpoints(ctx, m, targetCS); err != nil {
+				return err
+			}
+		}
+		if err := UpdateEndpoints(ctx, nodePortEndpoints(obj.(*corev1.Service), sourceNodes, m), m, targetCS); err != nil {
+			added = k8serror.IsNotFound(err)
+			return err
+		}
+		added = false
+		return nil
+	}
+
+	wctx := watchContext(ctx, m)
+	nodes = newAggregateSourceSyncer("nodes", m, labels.Everything(), &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			return sourceCS.CoreV1().Nodes().List(wctx, o)
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			return sourceCS.CoreV1().Nodes().Watch(wctx, o)
+		},
+	}, &corev1.Node{}, func(ctx context.Context, _ interface{}) error {
+		return update(ctx)
+	}, update)
+	services = newSourceSyncer("node-port-service", m, &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			return sourceCS.CoreV1().Services(m.SourceNamespace).List(wctx, withName(o, m.SourceName))
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			return sourceCS.CoreV1().Services(m.SourceNamespace).Watch(wctx, withName(o, m.SourceName))
+		},
+	}, &corev1.Service{}, func(ctx context.Context, _ interface{}) error {
+		return update(ctx)
+	}, func(ctx context.Context) error {
+		lock.Lock()
+		defer lock.Unlock()
+		added = true
+		switch m.OnDelete {
+		case DeletionDelete:
+			logrus.Infof("source service of mapping %s was deleted, deleting target endpoints", m)
+			return DeleteEndpoints(ctx, m.DestinationNamespace, m.DestinationName, targetCS)
+		case DeletionBlank:
+			logrus.Infof("source service of mapping %s was deleted, removing all target endpoints", m)
+			return UpdateEndpoints(ctx, &corev1.Endpoints{}, m, targetCS)
+		}
+		return nil
+	})
+
+	// the nodes are known before the service is synced, so the target endpoints are not emptied on startup
+	nodesDone, err := nodes.run(ctx)
+	if err != nil {
+		logrus.Errorf("error while establishing a watch connection from source: %s", err)
+		return nil, err
+	}
+	servicesDone, err := services.run(ctx)
+	if err != nil {
+		logrus.Errorf("error while establishing a watch connection from source: %s", err)
+		return nil, err
+	}
+	return joined(nodesDone, servicesDone), nil
+}
+
+//nodePortEndpoints builds endpoints with an address per source node and a port per node port of the source service.
+//Nodes that are not ready are listed as not ready addresses, nodes without an address of the node address type of the
+//mapping are skipped.
+func nodePortEndpoints(service *corev1.Service, nodes []*corev1.Node, m Mapping) *corev1.Endpoints {
+	var subset corev1.EndpointSubset
+	for _, p := range service.Spec.Ports {
+		if p.NodePort == 0 {
+			continue
+		}
+		subset.Ports = append(subset.Ports, corev1.EndpointPort{Name: p.Name, Port: p.NodePort, Protocol: p.Protocol})
+	}
+	endpoints := &corev1.Endpoints{}
+	if len(subset.Ports) == 0 {
+		logrus.Warnf("source service of mapping %s has no node ports", m)
+		return endpoints
+	}
+	sorted := make([]*corev1.Node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, n := range sorted {
+		for _, a := range n.Status.Addresses {
+			if a.Type != m.NodeAddressType {
+				continue
+			}
+			if isNodeReady(n) {
+				subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{IP: a.Address})
+			} else {
+				subset.NotReadyAddresses = append(subset.NotReadyAddresses, corev1.EndpointAddress{IP: a.Address})
+			}
+		}
+	}
+	// a subset needs at least one address
+	if len(subset.Addresses)+len(subset.NotReadyAddresses) > 0 {
+		endpoints.Subsets = []corev1.EndpointSubset{subset}
+	}
+	return endpoints
+}
+
+//nodePortServicePorts points the target ports of the destination service at the node ports of the source service. The
+//node ports of the source are not allocated in the destination.
+func nodePortServicePorts(ports []corev1.ServicePort) []corev1.ServicePort {
+	var transformed []corev1.ServicePort
+	for _, p := range ports {
+		if p.NodePort != 0 {
+			p.TargetPort = intstr.FromInt(int(p.NodePort))
+			p.NodePort = 0
+		}
+		transformed = append(transformed, p)
+	}
+	return transformed
+}
+
+func isNodeReady(n *corev1.Node) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
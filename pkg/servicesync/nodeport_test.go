@@ -0,0 +1,168 @@
+package servicesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func sourceNode(name, internalIP, externalIP string, ready bool) *corev1.Node {
+	status := corev1.ConditionTrue
+	if !ready {
+		status = corev1.ConditionFalse
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: internalIP},
+				{Type: corev1.NodeExternalIP, Address: externalIP},
+				{Type: corev1.NodeHostName, Address: name},
+			},
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func nodePortService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeNodePort,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080},
+				{Name: "https", Protocol: corev1.ProtocolTCP, Port: 443, NodePort: 30443},
+			},
+		},
+	}
+}
+
+func TestNodePortEndpoints(t *testing.T) {
+	nodes := []*corev1.Node{
+		sourceNode("node-b", "10.0.0.2", "203.0.113.2", false),
+		sourceNode("node-a", "10.0.0.1", "203.0.113.1", true),
+	}
+	m := Mapping{NodeAddressType: corev1.NodeExternalIP}
+	endpoints := nodePortEndpoints(nodePortService(), nodes, m)
+	if len(endpoints.Subsets) != 1 {
+		t.Fatalf("expected a single subset, got %v", endpoints.Subsets)
+	}
+	subset := endpoints.Subsets[0]
+	if len(subset.Addresses) != 1 || subset.Addresses[0].IP != "203.0.113.1" {
+		t.Errorf("expected the external address of the ready node, got %v", subset.Addresses)
+	}
+	if len(subset.NotReadyAddresses) != 1 || subset.NotReadyAddresses[0].IP != "203.0.113.2" {
+		t.Errorf("expected the external address of the not ready node, got %v", subset.NotReadyAddresses)
+	}
+	if len(subset.Ports) != 2 || subset.Ports[0].Name != "http" || subset.Ports[0].Port != 30080 || subset.Ports[1].Port != 30443 {
+		t.Errorf("expected the node ports, got %v", subset.Ports)
+	}
+
+	// a service without node ports has no endpoints
+	if endpoints := nodePortEndpoints(&corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}}}, nodes, m); len(endpoints.Subsets) != 0 {
+		t.Errorf("expected no subsets, got %v", endpoints.Subsets)
+	}
+}
+
+func TestTransformServiceNodePort(t *testing.T) {
+	transformed := transformService(nodePortService(), &corev1.Service{}, Mapping{EndpointMode: EndpointModeNodePort})
+	for _, p := range transformed.Spec.Ports {
+		if p.NodePort != 0 {
+			t.Errorf("node port %d of the source was copied", p.NodePort)
+		}
+	}
+	if transformed.Spec.Ports[0].Port != 80 || transformed.Spec.Ports[0].TargetPort.IntValue() != 30080 {
+		t.Errorf("expected port 80 to target node port 30080, got %v", transformed.Spec.Ports[0])
+	}
+}
+
+func TestSyncNodePortEndpoints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", EndpointMode: EndpointModeNodePort}
+	sourceCS := fake.NewSimpleClientset(nodePortService(), sourceNode("node-a", "10.0.0.1", "203.0.113.1", true))
+	targetCS := fake.NewSimpleClientset()
+	done, err := StartMapping(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAddresses := func(ready, notReady int) {
+		t.Helper()
+		e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "barService", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		foundReady, foundNotReady := 0, 0
+		for _, s := range e.Subsets {
+			foundReady += len(s.Addresses)
+			foundNotReady += len(s.NotReadyAddresses)
+		}
+		if foundReady != ready || foundNotReady != notReady {
+			t.Errorf("expected %d ready and %d not ready addresses, got %v", ready, notReady, e.Subsets)
+		}
+	}
+	expectAddresses(1, 0)
+
+	// added nodes and nodes that become unready are followed
+	if _, err := sourceCS.CoreV1().Nodes().Create(ctx, sourceNode("node-b", "10.0.0.2", "203.0.113.2", true), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectAddresses(2, 0)
+	if _, err := sourceCS.CoreV1().Nodes().Update(ctx, sourceNode("node-a", "10.0.0.1", "203.0.113.1", false), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectAddresses(1, 1)
+	if err := sourceCS.CoreV1().Nodes().Delete(ctx, "node-b", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectAddresses(0, 1)
+
+	// changed node ports are followed
+	service := nodePortService()
+	service.Spec.Ports = service.Spec.Ports[:1]
+	service.Spec.Ports[0].NodePort = 31080
+	if _, err := sourceCS.CoreV1().Services("foo").Update(ctx, service, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Subsets) != 1 || len(e.Subsets[0].Ports) != 1 || e.Subsets[0].Ports[0].Port != 31080 {
+		t.Errorf("expected node port 31080, got %v", e.Subsets)
+	}
+	cancel()
+	<-done
+}
+
+func TestValidateEndpointMode(t *testing.T) {
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", EndpointMode: EndpointModeNodePort}
+	m.setDefaults()
+	if err := m.validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if m.NodeAddressType != corev1.NodeInternalIP {
+		t.Errorf("expected node address type to default to %s, got %s", corev1.NodeInternalIP, m.NodeAddressType)
+	}
+	m.EndpointSlices = true
+	if err := m.validate(); err == nil {
+		t.Error("expected node-port mode with endpoint slices to be rejected")
+	}
+	m = Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", EndpointMode: "nat"}
+	if err := m.validate(); err == nil {
+		t.Error("expected unknown endpoint mode to be rejected")
+	}
+}
@@ -0,0 +1,162 @@
+package servicesync
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+//Summary is the outcome of syncing all mappings once.
+type Summary struct {
+	DryRun   bool            `json:"dryRun"`
+	Mappings []MappingResult `json:"mappings"`
+	//Changed is the number of destination objects that were changed.
+	Changed int `json:"changed"`
+	//Failed is the number of mappings, or destinations of fanned out mappings, that could not be synced.
+	Failed int `json:"failed"`
+}
+
+//MappingResult is the outcome of syncing a mapping once.
+type MappingResult struct {
+	Mapping string   `json:"mapping"`
+	Error   string   `json:"error,omitempty"`
+	Changes []Change `json:"changes"`
+}
+
+//Once creates and syncs the destination service and endpoints of all configured, discovered and exported mappings once,
+//without watching the sources. Fanned out mappings are synced to each of their destinations. With dry-run set the
+//writes are server-side dry-runs. A mapping that cannot be synced does not stop the others and is counted as failed in
+//the summary.
+func Once(ctx context.Context, v *viper.Viper) (*Summary, error) {
+	ConfigureResolver(v)
+	sourceCS, err := kubernetes.NewForConfig(v.Get("source-kube-config").(*rest.Config))
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := listMappings(ctx, v, sourceCS)
+	if err != nil {
+		return nil, err
+	}
+	return syncOnce(ctx, mappings, sourceCS, v.Get("destination-kube-config").(*rest.Config), v.GetBool("dry-run")), nil
+}
+
+//syncOnce syncs the mappings once and records the changes to the destination objects of every mapping.
+func syncOnce(ctx context.Context, mappings []Mapping, sourceCS kubernetes.Interface, targetConfig *rest.Config, dryRun bool) *Summary {
+	summary := &Summary{DryRun: dryRun, Mappings: []MappingResult{}}
+	for _, m := range mappings {
+		ds, err := destinations(m, targetConfig)
+		if err != nil {
+			logrus.Errorf("could not sync mapping %s: %s", m, err)
+			summary.Mappings = append(summary.Mappings, MappingResult{Mapping: m.String(), Error: err.Error(), Changes: []Change{}})
+			summary.Failed++
+			continue
+		}
+		for _, d := range ds {
+			summary.add(syncDestinationOnce(ctx, d, sourceCS, dryRun))
+		}
+	}
+	logrus.Infof("synced %d of %d mappings once, changing %d destination objects", len(summary.Mappings)-summary.Failed, len(summary.Mappings), summary.Changed)
+	return summary
+}
+
+//syncDestinationOnce syncs the mapping to a destination cluster once and records the changes.
+func syncDestinationOnce(ctx context.Context, d destination, sourceCS kubernetes.Interface, dryRun bool) MappingResult {
+	result := MappingResult{Mapping: d.mapping.String(), Changes: []Change{}}
+	t := newRecordingTransport(dryRun)
+	targetCS, err := kubernetes.NewForConfig(recordingConfig(d.config, t))
+	if err == nil {
+		err = syncMapping(ctx, d.mapping, sourceCS, targetCS)
+	}
+	// the changes made before a failure are reported as well
+	changes, changesErr := t.changes()
+	if err == nil {
+		err = changesErr
+	}
+	if err != nil {
+		logrus.Errorf("could not sync mapping %s: %s", d.mapping, err)
+		result.Error = err.Error()
+	}
+	result.Changes = append(result.Changes, changes...)
+	return result
+}
+
+//add counts the result of a mapping in the summary.
+func (s *Summary) add(result MappingResult) {
+	if result.Error != "" {
+		s.Failed++
+	}
+	s.Changed += len(result.Changes)
+	s.Mappings = append(s.Mappings, result)
+}
+
+//listMappings returns the configured mappings along with a mapping for every source service that currently matches a
+//discovery or is exported.
+func listMappings(ctx context.Context, v *viper.Viper, sourceCS kubernetes.Interface) ([]Mapping, error) {
+	mappings, err := MappingsFromConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	discoveries, err := DiscoveriesFromConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range discoveries {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+		for _, ns := range namespacesOrAll(d.SourceNamespaces) {
+			list, err := sourceCS.CoreV1().Services(ns).List(ctx, metav1.ListOptions{LabelSelector: d.Selector})
+			if err != nil {
+				return nil, err
+			}
+			for i := range list.Items {
+				mappings = append(mappings, d.mapping(&list.Items[i]))
+			}
+		}
+	}
+	export, err := ExportFromConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	if export != nil {
+		if err := export.validate(); err != nil {
+			return nil, err
+		}
+		for _, ns := range namespacesOrAll(export.SourceNamespaces) {
+			list, err := sourceCS.CoreV1().Services(ns).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			for i := range list.Items {
+				if exported(&list.Items[i]) {
+					mappings = append(mappings, export.mapping(&list.Items[i]))
+				}
+			}
+		}
+	}
+	// a service can be configured and discovered at the same time, see Manager.Start
+	seen := map[string]bool{}
+	var listed []Mapping
+	for _, m := range mappings {
+		if seen[m.String()] {
+			continue
+		}
+		seen[m.String()] = true
+		m.SourceCluster = v.GetString("source-cluster-name")
+		listed = append(listed, m)
+	}
+	return listed, nil
+}
+
+//namespacesOrAll returns the namespaces, or all namespaces if there are none.
+func namespacesOrAll(namespaces []string) []string {
+	if len(namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return namespaces
+}
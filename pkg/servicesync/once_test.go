@@ -0,0 +1,156 @@
+package servicesync
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+//objectServer is an API server that keeps the objects written to it by path. Dry-run writes are answered without
+//keeping the object.
+func objectServer(t *testing.T) (*httptest.Server, func(path string) []byte) {
+	var lock sync.Mutex
+	objects := map[string][]byte{}
+	status := func(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusFailure, Reason: reason, Code: int32(code)})
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := ioutil.ReadAll(r.Body)
+		path := r.URL.Path
+		if r.Method == http.MethodPost {
+			var obj metav1.PartialObjectMetadata
+			json.Unmarshal(body, &obj)
+			path += "/" + obj.Name
+		}
+		current, exists := objects[path]
+		dryRun := r.URL.Query().Get("dryRun") == metav1.DryRunAll
+		switch {
+		case r.Method == http.MethodPost && exists:
+			status(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+		case r.Method != http.MethodPost && !exists:
+			status(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		case r.Method == http.MethodGet:
+			w.Write(current)
+		case r.Method == http.MethodDelete:
+			if !dryRun {
+				delete(objects, path)
+			}
+			json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusSuccess})
+		default:
+			if !dryRun {
+				objects[path] = body
+			}
+			if r.Method == http.MethodPost {
+				w.WriteHeader(http.StatusCreated)
+			}
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func(path string) []byte {
+		lock.Lock()
+		defer lock.Unlock()
+		return objects[path]
+	}
+}
+
+func TestSyncOnce(t *testing.T) {
+	ctx := context.Background()
+	server, object := objectServer(t)
+	config := &rest.Config{Host: server.URL}
+	source := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	sourceCS := NewFake()
+	if _, err := sourceCS.CoreV1().Services("foo").Create(ctx, source, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService", SourceCluster: "source"}
+	missing := Mapping{SourceNamespace: "foo", SourceName: "missing", DestinationNamespace: "bar", DestinationName: "missing", SourceCluster: "source"}
+
+	summary := syncOnce(ctx, []Mapping{m, missing}, sourceCS, config, false)
+	if summary.Failed != 1 || summary.Mappings[1].Error == "" {
+		t.Errorf("expected the mapping of a missing source to fail, got %+v", summary)
+	}
+	expected := []Change{
+		{Action: "created", Resource: "endpoints", Namespace: "bar", Name: "barService"},
+		{Action: "created", Resource: "services", Namespace: "bar", Name: "barService"},
+	}
+	if !reflect.DeepEqual(summary.Mappings[0].Changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, summary.Mappings[0].Changes)
+	}
+	if object("/api/v1/namespaces/bar/services/barService") == nil {
+		t.Error("target service was not created")
+	}
+
+	// nothing changes without a change of the source
+	summary = syncOnce(ctx, []Mapping{m}, sourceCS, config, false)
+	if summary.Failed != 0 || summary.Changed != 0 {
+		t.Errorf("expected no changes, got %+v", summary)
+	}
+
+	// a dry-run reports the changes without writing them
+	source.Spec.Ports[0].Port = 8080
+	if _, err := sourceCS.CoreV1().Services("foo").Update(ctx, source, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	before := object("/api/v1/namespaces/bar/services/barService")
+	summary = syncOnce(ctx, []Mapping{m}, sourceCS, config, true)
+	expected = []Change{{Action: "updated", Resource: "services", Namespace: "bar", Name: "barService"}}
+	if !summary.DryRun || !reflect.DeepEqual(summary.Mappings[0].Changes, expected) {
+		t.Errorf("expected changes %v, got %+v", expected, summary)
+	}
+	if string(object("/api/v1/namespaces/bar/services/barService")) != string(before) {
+		t.Error("target service was changed by a dry-run")
+	}
+}
+
+func TestListMappings(t *testing.T) {
+	v := viper.New()
+	v.Set("source-cluster-name", "east")
+	v.Set("mappings", []map[string]interface{}{
+		{"source-namespace": "foo", "service": "fooService", "destination-namespace": "bar", "rename-service": "fooService"},
+	})
+	v.Set("selector", "app=foo")
+	v.Set("export", map[string]interface{}{"destination-namespace": "exported"})
+	sourceCS := fake.NewSimpleClientset(
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo", Labels: map[string]string{"app": "foo"}}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "foo", Annotations: map[string]string{ExportAnnotation: "true"}}},
+	)
+	mappings, err := listMappings(context.Background(), v, sourceCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, m := range mappings {
+		if m.SourceCluster != "east" {
+			t.Errorf("mapping %s is not from the source cluster", m)
+		}
+		listed = append(listed, m.String())
+	}
+	expected := []string{
+		Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "fooService"}.String(),
+		Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "foo", DestinationName: "fooService"}.String(),
+		Mapping{SourceNamespace: "foo", SourceName: "other", DestinationNamespace: "exported", DestinationName: "other"}.String(),
+	}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("expected mappings %v, got %v", expected, listed)
+	}
+}
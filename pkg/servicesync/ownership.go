@@ -0,0 +1,171 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	//ManagedByLabel marks destination objects that are created and updated by servicesync.
+	ManagedByLabel = "servicesync.io/managed-by"
+	managedByValue = "servicesync"
+	//SourceClusterAnnotation records the name of the source cluster of a managed destination object.
+	SourceClusterAnnotation = "servicesync.io/source-cluster"
+	//SourceNamespaceAnnotation records the namespace of the source service of a managed destination object.
+	SourceNamespaceAnnotation = "servicesync.io/source-namespace"
+	//SourceNameAnnotation records the name of the source service of a managed destination object.
+	SourceNameAnnotation = "servicesync.io/source-name"
+	//AdoptAnnotation allows servicesync to take over an existing destination object when set to "true".
+	AdoptAnnotation = "servicesync.io/adopt"
+)
+
+//ConflictError is returned when a destination object exists that is not managed by the mapping.
+type ConflictError struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Reason    string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %s/%s %s, set adopt on the mapping or annotate it with %s=true to take it over", e.Kind, e.Namespace, e.Name, e.Reason, AdoptAnnotation)
+}
+
+//checkOwnership returns a ConflictError unless the existing destination object is managed by the mapping or may be
+//adopted.
+func checkOwnership(kind string, obj metav1.Object, m Mapping) error {
+	if m.Adopt || obj.GetAnnotations()[AdoptAnnotation] == "true" {
+		return nil
+	}
+	conflict := &ConflictError{Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	if !isManaged(obj) {
+		conflict.Reason = "is not managed by servicesync"
+		return conflict
+	}
+	owner := ownerMapping(obj)
+	// the object is in the destination cluster of the mapping
+	owner.DestinationCluster = m.DestinationCluster
+	if owner.SourceCluster != m.SourceCluster || owner.String() != m.String() {
+		conflict.Reason = fmt.Sprintf("is managed by mapping %s of cluster %q", owner, owner.SourceCluster)
+		return conflict
+	}
+	return nil
+}
+
+//setOwnership stamps the destination object with the labels and annotations that mark it as managed by the mapping.
+func setOwnership(meta *metav1.ObjectMeta, m Mapping) {
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	meta.Labels[ManagedByLabel] = managedByValue
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[SourceClusterAnnotation] = m.SourceCluster
+	meta.Annotations[SourceNamespaceAnnotation] = m.SourceNamespace
+	meta.Annotations[SourceNameAnnotation] = m.SourceName
+}
+
+//isManaged returns whether the destination object was created or adopted by servicesync.
+func isManaged(meta metav1.Object) bool {
+	return meta.GetLabels()[ManagedByLabel] == managedByValue
+}
+
+//ownerMapping rebuilds the mapping of a managed destination object from its ownership annotations.
+func ownerMapping(meta metav1.Object) Mapping {
+	a := meta.GetAnnotations()
+	return Mapping{
+		SourceCluster:        a[SourceClusterAnnotation],
+		SourceNamespace:      a[SourceNamespaceAnnotation],
+		SourceName:           a[SourceNameAnnotation],
+		DestinationNamespace: meta.GetNamespace(),
+		DestinationName:      meta.GetName(),
+	}
+}
+
+//CollectGarbage deletes the managed services, endpoints and endpoint slices of the source cluster whose mapping is no longer in use
+//according to inUse. With dryRun the objects are only listed. The namespace/name of every collected object is
+//returned.
+func CollectGarbage(ctx context.Context, cluster string, inUse func(m Mapping) bool, targetCS kubernetes.Interface, dryRun bool) ([]string, error) {
+	opts := metav1.ListOptions{LabelSelector: ManagedByLabel + "=" + managedByValue}
+	var collected []string
+	collect := func(kind string, meta metav1.Object, m Mapping, del func() error) error {
+		if m.SourceCluster != cluster || inUse(m) {
+			return nil
+		}
+		name := fmt.Sprintf("%s %s/%s", kind, meta.GetNamespace(), meta.GetName())
+		collected = append(collected, name)
+		if dryRun {
+			logrus.Infof("dry run: would collect %s of retired mapping %s", name, m)
+			return nil
+		}
+		logrus.Infof("collecting %s of retired mapping %s", name, m)
+		return del()
+	}
+
+	services, err := targetCS.CoreV1().Services(metav1.NamespaceAll).List(ctx, opts)
+	if err != nil {
+		return collected, err
+	}
+	for i := range services.Items {
+		s := &services.Items[i]
+		if err := collect("service", s, ownerMapping(s), func() error { return DeleteService(ctx, s.Namespace, s.Name, targetCS) }); err != nil {
+			return collected, err
+		}
+	}
+	endpoints, err := targetCS.CoreV1().Endpoints(metav1.NamespaceAll).List(ctx, opts)
+	if err != nil {
+		return collected, err
+	}
+	for i := range endpoints.Items {
+		e := &endpoints.Items[i]
+		if err := collect("endpoints", e, ownerMapping(e), func() error { return DeleteEndpoints(ctx, e.Namespace, e.Name, targetCS) }); err != nil {
+			return collected, err
+		}
+	}
+	slices, err := targetCS.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(ctx, opts)
+	if err != nil {
+		return collected, err
+	}
+	for i := range slices.Items {
+		e := &slices.Items[i]
+		// slices are named after the service they belong to, not after the mapping
+		m := ownerMapping(e)
+		m.DestinationName = e.Labels[discoveryv1.LabelServiceName]
+		if err := collect("endpointslice", e, m, func() error {
+			err := targetCS.DiscoveryV1().EndpointSlices(e.Namespace).Delete(ctx, e.Name, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(e.UID))})
+			if k8serror.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}); err != nil {
+			return collected, err
+		}
+	}
+	return collected, nil
+}
+
+//RunGarbageCollection collects garbage every interval until ctx is done. The first pass runs after one interval so
+//that discovered mappings have been started by then.
+func RunGarbageCollection(ctx context.Context, interval time.Duration, cluster string, inUse func(m Mapping) bool, targetCS kubernetes.Interface, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := CollectGarbage(ctx, cluster, inUse, targetCS, dryRun); err != nil {
+				logrus.Errorf("error while collecting garbage: %s", err)
+			}
+		}
+	}
+}
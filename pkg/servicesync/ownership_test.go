@@ -0,0 +1,142 @@
+package servicesync
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func managedService(name, cluster, sourceName string) *corev1.Service {
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "bar",
+		},
+	}
+	setOwnership(&s.ObjectMeta, Mapping{SourceCluster: cluster, SourceNamespace: "foo", SourceName: sourceName})
+	return s
+}
+
+func TestEnsureServiceOwnership(t *testing.T) {
+	ctx := context.Background()
+	cs := fake.NewSimpleClientset()
+	m := Mapping{SourceCluster: "source", SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService"}
+	if err := EnsureService(ctx, m, cs); err != nil {
+		t.Fatal(err)
+	}
+	s, err := cs.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isManaged(s) {
+		t.Error("created service is not marked as managed")
+	}
+	if owner := ownerMapping(s); owner.String() != m.String() || owner.SourceCluster != "source" {
+		t.Errorf("ownership annotations do not match the mapping: %s", owner)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	cs := fake.NewSimpleClientset(
+		managedService("inUse", "source", "fooService"),
+		managedService("retired", "source", "oldService"),
+		managedService("otherCluster", "other", "oldService"),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "unmanaged",
+				Namespace: "bar",
+			},
+		},
+	)
+	inUse := func(m Mapping) bool {
+		return m.SourceName == "fooService"
+	}
+
+	collected, err := CollectGarbage(ctx, "source", inUse, cs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collected) != 1 || collected[0] != "service bar/retired" {
+		t.Errorf("unexpected garbage: %v", collected)
+	}
+	if _, err := cs.CoreV1().Services("bar").Get(ctx, "retired", metav1.GetOptions{}); err != nil {
+		t.Errorf("dry run deleted service: %s", err)
+	}
+
+	if _, err := CollectGarbage(ctx, "source", inUse, cs, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CoreV1().Services("bar").Get(ctx, "retired", metav1.GetOptions{}); err == nil {
+		t.Error("retired service was not collected")
+	}
+	for _, name := range []string{"inUse", "otherCluster", "unmanaged"} {
+		if _, err := cs.CoreV1().Services("bar").Get(ctx, name, metav1.GetOptions{}); err != nil {
+			t.Errorf("service %s should not be collected: %s", name, err)
+		}
+	}
+}
+
+func TestEnsureServiceConflict(t *testing.T) {
+	ctx := context.Background()
+	cs := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "barService",
+			Namespace: "bar",
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{
+				"app": "bar",
+			},
+		},
+	}, managedService("otherService", "source", "otherSource"))
+	recorder := record.NewFakeRecorder(10)
+	recordersLock.Lock()
+	recorders[cs] = recorder
+	recordersLock.Unlock()
+
+	m := Mapping{SourceCluster: "source", SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService"}
+	err := EnsureService(ctx, m, cs)
+	if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("unmanaged service should conflict but got: %v", err)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "Conflict") {
+			t.Errorf("unexpected event: %s", e)
+		}
+	default:
+		t.Error("conflict was not recorded as an event")
+	}
+	if err := DeleteService(ctx, "bar", "barService", cs); err == nil {
+		t.Error("unmanaged service should not be deleted")
+	}
+
+	m.DestinationName = "otherService"
+	if err := EnsureService(ctx, m, cs); err == nil {
+		t.Error("service managed by another mapping should conflict")
+	}
+
+	m.DestinationName = "barService"
+	m.Adopt = true
+	if err := GetAndUpdateService(ctx, m, fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+	}), cs); err != nil {
+		t.Fatalf("service should be adopted: %s", err)
+	}
+	s, err := cs.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isManaged(s) {
+		t.Error("adopted service is not marked as managed")
+	}
+}
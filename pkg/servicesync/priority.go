@@ -0,0 +1,112 @@
+package servicesync
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//defaultFailbackDelay is how long a degraded source needs enough ready addresses before it is published again.
+const defaultFailbackDelay = 30 * time.Second
+
+//prioritySource returns the source to publish with the priority policy. The first source in the order of the sources
+//that has enough ready addresses is published, except that a source that was degraded has to have enough of them for
+//the failback delay before it replaces the active source. Sources that were never degraded, e.g. when they are synced
+//for the first time, are not delayed. If no source has enough ready addresses the active source is kept, or the source
+//with the most ready addresses is published if there is none yet.
+func (e *endpointsMerge) prioritySource(now time.Time) string {
+	m := e.mapping
+	eligible := map[string]bool{}
+	for _, s := range m.Sources {
+		ready := readyAddresses(e.endpoints[s.Name], m)
+		eligible[s.Name] = ready >= m.MinReadyAddresses
+		_, wasEligible := e.eligibleSince[s.Name]
+		switch {
+		case eligible[s.Name] && !wasEligible:
+			e.eligibleSince[s.Name] = now
+		case !eligible[s.Name] && wasEligible:
+			delete(e.eligibleSince, s.Name)
+			e.degraded[s.Name] = true
+		}
+	}
+	var wait time.Duration
+	defer func() {
+		if wait > 0 {
+			e.scheduleFailback(wait)
+		}
+	}()
+	for _, s := range m.Sources {
+		if !eligible[s.Name] {
+			continue
+		}
+		if s.Name == e.active {
+			// no source of higher priority is ready long enough
+			return s.Name
+		}
+		if e.degraded[s.Name] && eligible[e.active] {
+			if remaining := e.eligibleSince[s.Name].Add(m.FailbackDelay).Sub(now); remaining > 0 {
+				if wait == 0 || remaining < wait {
+					wait = remaining
+				}
+				continue
+			}
+		}
+		return s.Name
+	}
+	if e.active != "" {
+		return e.active
+	}
+	best, most := "", -1
+	for _, s := range m.Sources {
+		if ready := readyAddresses(e.endpoints[s.Name], m); ready > most {
+			best, most = s.Name, ready
+		}
+	}
+	return best
+}
+
+//scheduleFailback syncs the sources again after wait, to publish a source of higher priority once it has been ready for
+//the failback delay.
+func (e *endpointsMerge) scheduleFailback(wait time.Duration) {
+	if e.failback != nil {
+		e.failback.Stop()
+	}
+	e.failback = time.AfterFunc(wait, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		for _, resync := range e.resyncs {
+			resync()
+		}
+	})
+}
+
+//switchSource makes source the active source. Switches are recorded once every source has reported. Until then, up to
+//and including the first report of the last source, they only settle which source is published.
+func (e *endpointsMerge) switchSource(source string) {
+	previous := e.active
+	e.active = source
+	if previous == "" || len(e.reported) < len(e.mapping.Sources) {
+		return
+	}
+	m := e.mapping
+	logrus.Warnf("switching the published source of mapping %s from %s to %s", m, previous, source)
+	recordSourceSwitch(m, source)
+	ref := &corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: m.DestinationName, Namespace: m.DestinationNamespace}}
+	eventRecorder(e.targetCS).Eventf(ref, corev1.EventTypeNormal, "SourceSwitched", "Publishing the endpoints of source %s instead of %s", source, previous)
+}
+
+//readyAddresses returns the number of ready addresses of the endpoints that are published to the destination of the
+//mapping.
+func readyAddresses(e *corev1.Endpoints, m Mapping) int {
+	if e == nil {
+		return 0
+	}
+	ready := 0
+	for _, s := range transformEndpoints(e, m).Subsets {
+		ready += len(s.Addresses)
+	}
+	return ready
+}
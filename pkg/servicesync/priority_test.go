@@ -0,0 +1,152 @@
+package servicesync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+//readyEndpoints returns source endpoints with n ready addresses.
+func readyEndpoints(n int) *corev1.Endpoints {
+	e := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Subsets:    []corev1.EndpointSubset{{Ports: []corev1.EndpointPort{{Port: 80}}}},
+	}
+	for i := 0; i < n; i++ {
+		e.Subsets[0].Addresses = append(e.Subsets[0].Addresses, corev1.EndpointAddress{IP: fmt.Sprintf("1.2.3.%d", i+1)})
+	}
+	return e
+}
+
+func TestPrioritySource(t *testing.T) {
+	m := Mapping{SourceNamespace: "priority", SourceName: "fooService", DestinationNamespace: "bar", SourcePolicy: SourcePolicyPriority, MinReadyAddresses: 2, FailbackDelay: time.Hour, Sources: []Source{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "west", KubeConfig: "west.yaml"},
+		{Name: "north", KubeConfig: "north.yaml"},
+	}}
+	m.setDefaults()
+	e := newEndpointsMerge(m, fake.NewSimpleClientset())
+	for _, s := range m.Sources {
+		e.reported[s.Name] = true
+	}
+	defer func() {
+		if e.failback != nil {
+			e.failback.Stop()
+		}
+	}()
+	switches := sourceSwitches.WithLabelValues(m.String(), "west")
+	before := testutil.ToFloat64(switches)
+	now := time.Now()
+	expectActive := func(want string) {
+		t.Helper()
+		e.published(now)
+		if e.active != want {
+			t.Errorf("expected source %s to be published, got %q", want, e.active)
+		}
+	}
+
+	// before any source is ready the one with the most ready addresses is published
+	e.endpoints["west"] = readyEndpoints(1)
+	expectActive("west")
+	// a source that was never degraded is published without delay
+	e.endpoints["east"] = readyEndpoints(2)
+	e.endpoints["west"] = readyEndpoints(3)
+	expectActive("east")
+
+	// a degraded source falls through to the next one
+	e.endpoints["east"] = readyEndpoints(1)
+	expectActive("west")
+	if v := testutil.ToFloat64(switches) - before; v != 1 {
+		t.Errorf("expected 1 switch to west, got %v", v)
+	}
+
+	// and is only published again once it has been ready for the failback delay
+	e.endpoints["east"] = readyEndpoints(2)
+	expectActive("west")
+	if e.failback == nil {
+		t.Error("expected the failback to be scheduled")
+	}
+	now = now.Add(time.Hour + time.Second)
+	expectActive("east")
+
+	// without a ready source the active one is kept
+	e.endpoints["east"] = nil
+	e.endpoints["west"] = nil
+	expectActive("east")
+}
+
+func TestStartMergePriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	east := fake.NewSimpleClientset(sourceEndpoints("1.1.1.1"), &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "fooService", Namespace: "foo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	})
+	west := fake.NewSimpleClientset(sourceEndpoints("2.2.2.2"))
+	targetCS := fake.NewSimpleClientset()
+	recorder := record.NewFakeRecorder(10)
+	recordersLock.Lock()
+	recorders[targetCS] = recorder
+	recordersLock.Unlock()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", SourcePolicy: SourcePolicyPriority, FailbackDelay: 2 * sleepLength, Sources: []Source{
+		{Name: "east", KubeConfig: "east.yaml"},
+		{Name: "west", KubeConfig: "west.yaml"},
+	}}
+	done, err := StartMerge(ctx, m, map[string]kubernetes.Interface{"east": east, "west": west}, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIP := func(want string) {
+		t.Helper()
+		e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "fooService", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.Subsets) != 1 || len(e.Subsets[0].Addresses) != 1 || e.Subsets[0].Addresses[0].IP != want {
+			t.Errorf("expected address %s, got %v", want, e.Subsets)
+		}
+	}
+	time.Sleep(sleepLength)
+	expectIP("1.1.1.1")
+
+	degraded := sourceEndpoints("1.1.1.1")
+	degraded.Subsets[0].NotReadyAddresses = degraded.Subsets[0].Addresses
+	degraded.Subsets[0].Addresses = nil
+	if _, err := east.CoreV1().Endpoints("foo").Update(ctx, degraded, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectIP("2.2.2.2")
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "SourceSwitched") || !strings.Contains(e, "source west instead of east") {
+			t.Errorf("unexpected event: %s", e)
+		}
+	default:
+		t.Error("switch was not recorded as an event")
+	}
+	// the switch while the sources were synced for the first time is not recorded
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected a single event, got %d more", len(recorder.Events))
+	}
+
+	// the recovered source is published again after the failback delay without further changes
+	if _, err := east.CoreV1().Endpoints("foo").Update(ctx, sourceEndpoints("1.1.1.1"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	expectIP("2.2.2.2")
+	time.Sleep(2 * sleepLength)
+	expectIP("1.1.1.1")
+	cancel()
+	<-done
+}
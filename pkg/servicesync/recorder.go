@@ -0,0 +1,504 @@
+package servicesync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+//syncedResources are the resources of the destination objects servicesync writes.
+var syncedResources = map[string]bool{"services": true, "endpoints": true, "endpointslices": true}
+
+//recordingConfig returns a copy of config whose requests go through t. JSON is used so that t can read the objects.
+func recordingConfig(config *rest.Config, t *recordingTransport) *rest.Config {
+	config = rest.CopyConfig(config)
+	config.ContentType = runtime.ContentTypeJSON
+	config.AcceptContentTypes = runtime.ContentTypeJSON
+	wrap := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return t.wrap(rt)
+	}
+	return config
+}
+
+//recordedObject is an object written through a recordingTransport.
+type recordedObject struct {
+	// original is the object in the cluster before the first write, nil if it did not exist.
+	original []byte
+	// current is the object after the last write, nil if it was deleted.
+	current []byte
+}
+
+//recordingTransport keeps the objects before and after they are written, by path, to report the changes. In a dry-run
+//the writes are sent as server-side dry-runs and the resulting objects answer later reads of the same objects. Lists of
+//the syncedResources in a namespace include the dry-run objects in place of the ones in the cluster, while watches are
+//served by the cluster alone.
+type recordingTransport struct {
+	dryRun bool
+	// cluster is the name of the destination cluster in diffs, empty for the default destination cluster.
+	cluster string
+	// log enables logging every write along with its changes.
+	log bool
+
+	lock    sync.Mutex
+	objects map[string]*recordedObject
+}
+
+func newRecordingTransport(dryRun bool) *recordingTransport {
+	return &recordingTransport{dryRun: dryRun, objects: map[string]*recordedObject{}}
+}
+
+//wrap returns a round tripper that sends the requests of t to rt. All round trippers share the objects of t.
+func (t *recordingTransport) wrap(rt http.RoundTripper) http.RoundTripper {
+	return &recordingRoundTripper{recordingTransport: t, next: rt}
+}
+
+type recordingRoundTripper struct {
+	*recordingTransport
+	next http.RoundTripper
+}
+
+func (t *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet:
+		if t.dryRun && req.URL.Query().Get("watch") == "" {
+			if isNamespacedList(req.URL.Path) {
+				return t.list(req)
+			}
+			t.lock.Lock()
+			o, ok := t.objects[req.URL.Path]
+			t.lock.Unlock()
+			if ok {
+				return objectResponse(req, o.current)
+			}
+		}
+		return t.next.RoundTrip(req)
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return t.write(req)
+	}
+	return t.next.RoundTrip(req)
+}
+
+//isNamespacedList returns whether path lists one of the syncedResources in a namespace, such as
+///api/v1/namespaces/bar/endpoints.
+func isNamespacedList(path string) bool {
+	parts := strings.Split(path, "/")
+	return len(parts) > 3 && parts[len(parts)-3] == "namespaces" && syncedResources[parts[len(parts)-1]]
+}
+
+//list answers req with the list of the cluster, in which the dry-run objects replace the ones of the same name. Dry-run
+//objects are selected by the label selector of req.
+func (t *recordingRoundTripper) list(req *http.Request) (*http.Response, error) {
+	selector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var list map[string]interface{}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	prefix := req.URL.Path + "/"
+	recorded := map[string][]byte{}
+	t.lock.Lock()
+	for p, o := range t.objects {
+		if name := strings.TrimPrefix(p, prefix); name != p && !strings.Contains(name, "/") {
+			recorded[name] = o.current
+		}
+	}
+	t.lock.Unlock()
+	items, _ := list["items"].([]interface{})
+	merged := []interface{}{}
+	for _, item := range items {
+		var name string
+		if o, ok := item.(map[string]interface{}); ok {
+			name, _, _ = unstructured.NestedString(o, "metadata", "name")
+		}
+		if _, ok := recorded[name]; !ok {
+			merged = append(merged, item)
+		}
+	}
+	names := make([]string, 0, len(recorded))
+	for name := range recorded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if recorded[name] == nil {
+			// deleted in the dry-run
+			continue
+		}
+		var o map[string]interface{}
+		if err := json.Unmarshal(recorded[name], &o); err != nil {
+			return nil, err
+		}
+		objLabels, _, _ := unstructured.NestedStringMap(o, "metadata", "labels")
+		if selector.Matches(labels.Set(objLabels)) {
+			merged = append(merged, o)
+		}
+	}
+	list["items"] = merged
+	if body, err = json.Marshal(list); err != nil {
+		return nil, err
+	}
+	return jsonResponse(req, resp.StatusCode, body), nil
+}
+
+//write sends req, as a server-side dry-run if enabled, and records the resulting object.
+func (t *recordingRoundTripper) write(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	path := strings.TrimSuffix(req.URL.Path, "/status")
+	if req.Method == http.MethodPost {
+		var obj metav1.PartialObjectMetadata
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return nil, fmt.Errorf("could not read object to create: %s", err)
+		}
+		path += "/" + obj.Name
+	}
+	if !syncedResources[resourceOf(path)] {
+		// other objects such as events are neither logged nor served, or they would pile up in a long running dry-run
+		return t.next.RoundTrip(t.request(req, req.Method, *req.URL, body))
+	}
+	t.lock.Lock()
+	o, ok := t.objects[path]
+	t.lock.Unlock()
+	if !ok {
+		original, err := t.get(req, path)
+		if err != nil {
+			return nil, err
+		}
+		o = &recordedObject{original: original, current: original}
+	}
+
+	method, u := req.Method, *req.URL
+	switch {
+	case !t.dryRun:
+		// the cluster knows about all objects
+	case req.Method == http.MethodDelete && o.current != nil && o.original == nil:
+		// the object only exists in the dry-run
+		resp, err := statusResponse(req, http.StatusOK, metav1.StatusSuccess, "", "")
+		if err != nil {
+			return nil, err
+		}
+		t.record(req, path, o, nil)
+		return resp, nil
+	case req.Method == http.MethodPut && o.current != nil && o.original == nil:
+		// the object only exists in the dry-run, so the cluster can only validate creating it
+		method = http.MethodPost
+		u.Path = path[:strings.LastIndex(path, "/")]
+		var err error
+		if body, err = withoutResourceVersion(body); err != nil {
+			return nil, err
+		}
+	case req.Method == http.MethodPost && o.current != nil && o.original == nil:
+		return statusResponse(req, http.StatusConflict, metav1.StatusFailure, metav1.StatusReasonAlreadyExists, fmt.Sprintf("%s already exists", path))
+	case req.Method == http.MethodPost && o.current == nil && o.original != nil:
+		// the object was deleted in the dry-run, so the cluster cannot validate creating it again
+		t.record(req, path, o, body)
+		return jsonResponse(req, http.StatusCreated, body), nil
+	case req.Method != http.MethodPost && o.current == nil:
+		return statusResponse(req, http.StatusNotFound, metav1.StatusFailure, metav1.StatusReasonNotFound, fmt.Sprintf("%s not found", path))
+	}
+	resp, err := t.next.RoundTrip(t.request(req, method, u, body))
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(result))
+	resp.ContentLength = int64(len(result))
+	if req.Method == http.MethodDelete {
+		result = nil
+	}
+	t.record(req, path, o, result)
+	return resp, nil
+}
+
+//request returns a copy of req that sends body with method to u, as a server-side dry-run if enabled.
+func (t *recordingRoundTripper) request(req *http.Request, method string, u url.URL, body []byte) *http.Request {
+	if t.dryRun {
+		q := u.Query()
+		q.Set("dryRun", metav1.DryRunAll)
+		u.RawQuery = q.Encode()
+	}
+	write := req.Clone(req.Context())
+	write.Method = method
+	write.URL = &u
+	write.Body = ioutil.NopCloser(bytes.NewReader(body))
+	write.ContentLength = int64(len(body))
+	return write
+}
+
+//record stores the object at path after a write and logs the change if enabled.
+func (t *recordingRoundTripper) record(req *http.Request, path string, o *recordedObject, result []byte) {
+	previous := o.current
+	t.lock.Lock()
+	t.objects[path] = &recordedObject{original: o.original, current: result}
+	t.lock.Unlock()
+	if t.log {
+		d, err := unifiedDiff(t.objectName(path), previous, result)
+		if err != nil {
+			logrus.Warnf("could not diff %s: %s", path, err)
+		}
+		logrus.Infof("dry-run: %s %s\n%s", req.Method, path, d)
+	}
+}
+
+//get reads the object at path from the cluster, or returns nil if it does not exist.
+func (t *recordingRoundTripper) get(req *http.Request, path string) ([]byte, error) {
+	get, err := http.NewRequestWithContext(req.Context(), http.MethodGet, (&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: path}).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	get.Header = req.Header.Clone()
+	get.Header.Del("Content-Type")
+	resp, err := t.next.RoundTrip(get)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode >= http.StatusMultipleChoices:
+		return nil, fmt.Errorf("could not get %s: %s: %s", path, resp.Status, body)
+	}
+	return body, nil
+}
+
+//diff writes a unified diff of every object written to one of the syncedResources and returns whether any changed.
+func (t *recordingTransport) diff(out io.Writer) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	paths := make([]string, 0, len(t.objects))
+	for p := range t.objects {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	changed := false
+	for _, p := range paths {
+		if !syncedResources[resourceOf(p)] {
+			continue
+		}
+		d, err := unifiedDiff(t.objectName(p), t.objects[p].original, t.objects[p].current)
+		if err != nil {
+			return changed, err
+		}
+		if d == "" {
+			continue
+		}
+		changed = true
+		if _, err := io.WriteString(out, d); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+//Change is a destination object that was created, updated or deleted.
+type Change struct {
+	Action    string `json:"action"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+//changes returns the objects of the syncedResources that were changed by the writes, ordered by path. An object that
+//was written without changing it, e.g. by an update with the current state, is not a change.
+func (t *recordingTransport) changes() ([]Change, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	paths := make([]string, 0, len(t.objects))
+	for p := range t.objects {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var changes []Change
+	for _, p := range paths {
+		if !syncedResources[resourceOf(p)] {
+			continue
+		}
+		o := t.objects[p]
+		c := Change{Resource: resourceOf(p)}
+		parts := strings.Split(p, "/")
+		c.Name = parts[len(parts)-1]
+		if len(parts) > 3 && parts[len(parts)-4] == "namespaces" {
+			c.Namespace = parts[len(parts)-3]
+		}
+		switch {
+		case o.original == nil && o.current != nil:
+			c.Action = "created"
+		case o.original != nil && o.current == nil:
+			c.Action = "deleted"
+		case o.original != nil:
+			before, err := diffYAML(o.original)
+			if err != nil {
+				return nil, err
+			}
+			after, err := diffYAML(o.current)
+			if err != nil {
+				return nil, err
+			}
+			if before == after {
+				continue
+			}
+			c.Action = "updated"
+		default:
+			// created and deleted again
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+//objectName returns the namespace, resource and name of the object at path, prefixed by the cluster if it is not the
+//default destination cluster.
+func (t *recordingTransport) objectName(path string) string {
+	name := path
+	if i := strings.Index(path, "/namespaces/"); i >= 0 {
+		name = path[i+len("/namespaces/"):]
+	}
+	if t.cluster != "" {
+		name = t.cluster + "/" + name
+	}
+	return name
+}
+
+//unifiedDiff returns a unified diff between the YAML of two JSON objects, without the fields that are maintained by the
+//cluster. A nil object does not exist. The diff is empty if the objects do not differ.
+func unifiedDiff(name string, a, b []byte) (string, error) {
+	ya, err := diffYAML(a)
+	if err != nil {
+		return "", err
+	}
+	yb, err := diffYAML(b)
+	if err != nil {
+		return "", err
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(ya),
+		B:        difflib.SplitLines(yb),
+		FromFile: "current/" + name,
+		ToFile:   "servicesync/" + name,
+		Context:  3,
+	})
+}
+
+//diffYAML converts a JSON object to YAML without its status and the metadata maintained by the cluster.
+func diffYAML(obj []byte) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	var o map[string]interface{}
+	if err := json.Unmarshal(obj, &o); err != nil {
+		return "", err
+	}
+	delete(o, "status")
+	if meta, ok := o["metadata"].(map[string]interface{}); ok {
+		for _, f := range []string{"managedFields", "resourceVersion", "uid", "generation", "creationTimestamp", "selfLink"} {
+			delete(meta, f)
+		}
+	}
+	y, err := yaml.Marshal(o)
+	return string(y), err
+}
+
+//resourceOf returns the resource of an object path such as /api/v1/namespaces/bar/services/barService.
+func resourceOf(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+func withoutResourceVersion(body []byte) ([]byte, error) {
+	var o map[string]interface{}
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, err
+	}
+	if meta, ok := o["metadata"].(map[string]interface{}); ok {
+		delete(meta, "resourceVersion")
+	}
+	return json.Marshal(o)
+}
+
+//objectResponse answers req with the object, or with NotFound if it is nil.
+func objectResponse(req *http.Request, obj []byte) (*http.Response, error) {
+	if obj == nil {
+		return statusResponse(req, http.StatusNotFound, metav1.StatusFailure, metav1.StatusReasonNotFound, fmt.Sprintf("%s not found", req.URL.Path))
+	}
+	return jsonResponse(req, http.StatusOK, obj), nil
+}
+
+func statusResponse(req *http.Request, code int, status string, reason metav1.StatusReason, message string) (*http.Response, error) {
+	body, err := json.Marshal(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   status,
+		Reason:   reason,
+		Message:  message,
+		Code:     int32(code),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jsonResponse(req, code, body), nil
+}
+
+func jsonResponse(req *http.Request, code int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{runtime.ContentTypeJSON}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
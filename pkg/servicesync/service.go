@@ -2,94 +2,253 @@ package servicesync
 
 import (
 	"context"
-	"net/http"
+	"fmt"
+	"reflect"
 
 	"github.com/sirupsen/logrus"
 
 	corev1 "k8s.io/api/core/v1"
 	k8serror "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
-//EnsureService ensures that getting the service will not lead to a 404. An empty service is created if not found.
-func EnsureService(ctx context.Context, namespace, targetName string, cs kubernetes.Interface) error {
-	_, err := cs.CoreV1().Services(namespace).Get(ctx, targetName, metav1.GetOptions{})
-	if err != nil {
-		if err.(*k8serror.StatusError).Status().Code == http.StatusNotFound {
-			_, err = cs.CoreV1().Services(namespace).Create(ctx, &corev1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      targetName,
-					Namespace: namespace,
-				},
-				Spec: corev1.ServiceSpec{
-					Ports: []corev1.ServicePort{
-						{
-							Port: 80,
-						},
-					},
+//EnsureService ensures that getting the service will not lead to a 404. An empty service is created if not found. An
+//existing service that is not managed by the mapping results in a ConflictError.
+func EnsureService(ctx context.Context, m Mapping, cs kubernetes.Interface) error {
+	target, err := cs.CoreV1().Services(m.DestinationNamespace).Get(ctx, m.DestinationName, metav1.GetOptions{})
+	if err == nil {
+		return checkServiceOwnership(target, m, cs)
+	}
+	if !k8serror.IsNotFound(err) {
+		logrus.Errorf("Unexpected error while ensuring service: %s", err)
+		return err
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m.DestinationName,
+			Namespace: m.DestinationNamespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Port: 80,
 				},
-			}, metav1.CreateOptions{})
-			if err != nil {
-				logrus.Errorf("Unexpected error while creating service: %s", err)
-				return err
-			}
-		} else {
-			logrus.Errorf("Unexpected error while ensuring service: %s", err)
-			return err
-		}
+			},
+		},
+	}
+	if m.Headless {
+		service.Spec.ClusterIP = corev1.ClusterIPNone
+	}
+	if (m.DestinationType == DestinationTypeExternalName || m.EndpointMode == EndpointModeAlias) && m.ExternalName != "" {
+		service.Spec.Type = corev1.ServiceTypeExternalName
+		service.Spec.ExternalName = m.ExternalName
+	}
+	setOwnership(&service.ObjectMeta, m)
+	_, err = cs.CoreV1().Services(m.DestinationNamespace).Create(ctx, service, metav1.CreateOptions{})
+	if err != nil {
+		logrus.Errorf("Unexpected error while creating service: %s", err)
+		return err
 	}
 	return nil
 }
 
 //GetAndUpdateService does a one time sync between the source and target service resource
-func GetAndUpdateService(ctx context.Context, sourceNamespace, sourceName, targetNamespace, targetName string, sourceCS, targetCS kubernetes.Interface) error {
-	s, err := sourceCS.CoreV1().Services(sourceNamespace).Get(ctx, sourceName, metav1.GetOptions{})
+func GetAndUpdateService(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	s, err := sourceCS.CoreV1().Services(m.SourceNamespace).Get(ctx, m.SourceName, metav1.GetOptions{})
 	if err != nil {
 		logrus.Errorf("error while getting service definition from source: %s", err)
 		return err
 	}
-	return UpdateService(ctx, s, targetNamespace, targetName, targetCS)
+	return UpdateService(ctx, s, m, targetCS)
 }
 
-func SyncService(ctx context.Context, sourceNamespace, sourceName, targetNamespace, targetName string, sourceCS, targetCS kubernetes.Interface) error {
-	w, err := sourceCS.CoreV1().Services(sourceNamespace).Watch(ctx, metav1.ListOptions{})
+//SyncService keeps the target service in sync with the source service until ctx is done. A recreated source service
+//is synced again and a deleted one is handled according to the OnDelete policy of the mapping. It returns once the
+//initial state of the source service has been observed. The returned channel is closed once ctx is done and the sync
+//in flight, if any, has completed.
+func SyncService(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	wctx := watchContext(ctx, m)
+	lw := &cache.ListWatch{
+		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+			return sourceCS.CoreV1().Services(m.SourceNamespace).List(wctx, withName(o, m.SourceName))
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			return sourceCS.CoreV1().Services(m.SourceNamespace).Watch(wctx, withName(o, m.SourceName))
+		},
+	}
+	// added is true until the source has been synced and again once it was deleted. A source that is added again may
+	// be synced to a destination that was deleted along with its previous incarnation.
+	added := true
+	// refresh is true once the target service was recreated until its endpoints were synced again, as the endpoints of
+	// the old service may have been deleted along with it.
+	refresh := false
+	s := newSourceSyncer("service", m, lw, &corev1.Service{}, func(ctx context.Context, obj interface{}) error {
+		if added {
+			if err := EnsureService(ctx, m, targetCS); err != nil {
+				return err
+			}
+		}
+		recreated, err := updateService(ctx, obj.(*corev1.Service), m, targetCS)
+		if k8serror.IsNotFound(err) {
+			// the target was deleted, e.g. by a recreation that failed half way
+			added = true
+		}
+		if err != nil {
+			return err
+		}
+		added = false
+		if recreated {
+			refresh = true
+		}
+		if refresh {
+			if err := refreshEndpoints(ctx, m, sourceCS, targetCS); err != nil {
+				return err
+			}
+			refresh = false
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		added = true
+		if m.OnDelete != DeletionDelete {
+			return nil
+		}
+		logrus.Infof("source service of mapping %s was deleted, deleting target service", m)
+		return DeleteService(ctx, m.DestinationNamespace, m.DestinationName, targetCS)
+	})
+	done, err := s.run(ctx)
 	if err != nil {
 		logrus.Errorf("error while establishing a watch connection from source: %s", err)
-		return err
+		return nil, err
 	}
-	wc := w.ResultChan()
-	go func() {
-		for {
-			event := <-wc
-			if event.Type == "MODIFIED" {
-				if source := event.Object.(*corev1.Service); source.Name == sourceName {
-					if err = UpdateService(ctx, source, targetNamespace, targetName, targetCS); err != nil {
-						logrus.Errorf("error while updating service: %s", err)
-					}
-				}
-			}
+	return done, nil
+}
+
+//refreshEndpoints syncs the target endpoints of a recreated target service, creating them if they were deleted.
+func refreshEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	if m.EndpointMode == EndpointModeAlias {
+		return nil
+	}
+	if !m.EndpointSlices {
+		if err := EnsureEndpoints(ctx, m, targetCS); err != nil {
+			return err
 		}
-	}()
-	return nil
+	}
+	return getAndUpdateEndpoints(ctx, m, sourceCS, targetCS)
+}
+
+//UpdateService updates the target service from the source service. The target service is recreated if the change
+//cannot be applied to the existing service.
+func UpdateService(ctx context.Context, source *corev1.Service, m Mapping, targetCS kubernetes.Interface) error {
+	_, err := updateService(ctx, source, m, targetCS)
+	return err
 }
 
-func UpdateService(ctx context.Context, source *corev1.Service, targetNamespace, targetName string, targetCS kubernetes.Interface) error {
-	target, err := targetCS.CoreV1().Services(targetNamespace).Get(ctx, targetName, metav1.GetOptions{})
+//updateService updates the target service and returns whether it was recreated.
+func updateService(ctx context.Context, source *corev1.Service, m Mapping, targetCS kubernetes.Interface) (bool, error) {
+	target, err := targetCS.CoreV1().Services(m.DestinationNamespace).Get(ctx, m.DestinationName, metav1.GetOptions{})
 	if err != nil {
 		logrus.Errorf("error while getting existing target service: %s", err)
-		return err
+		recordSync(m, "service", err)
+		return false, err
+	}
+	if err := checkServiceOwnership(target, m, targetCS); err != nil {
+		recordSync(m, "service", err)
+		return false, err
+	}
+	if m.EndpointMode == EndpointModeAlias {
+		name, err := aliasName(source, m)
+		if err != nil {
+			logrus.Error(err)
+			recordSync(m, "service", err)
+			return false, err
+		}
+		m.ExternalName = name
+	}
+	service := transformService(source, target, m)
+	setOwnership(&service.ObjectMeta, m)
+	if service.Spec.Type == corev1.ServiceTypeExternalName && service.Spec.ExternalName == "" {
+		err := fmt.Errorf("mapping %s has no external name for ExternalName service %s/%s", m, service.Namespace, service.Name)
+		logrus.Error(err)
+		recordSync(m, "service", err)
+		return false, err
 	}
-	service := transformService(source, target)
-	_, err = targetCS.CoreV1().Services(targetNamespace).Update(ctx, service, metav1.UpdateOptions{})
+	if isHeadless(service) != isHeadless(target) {
+		// the cluster IP of a service is immutable
+		err = recreateService(ctx, target, service, m, targetCS)
+		recordSync(m, "service", err)
+		return err == nil, err
+	}
+	recreated := false
+	_, err = targetCS.CoreV1().Services(m.DestinationNamespace).Update(ctx, service, metav1.UpdateOptions{})
+	if k8serror.IsInvalid(err) && !reflect.DeepEqual(service.Spec.IPFamilies, target.Spec.IPFamilies) {
+		// the destination does not support the IP families of the source, e.g. because it is not dual-stack
+		logrus.Warnf("destination rejected IP families %v of mapping %s, keeping %v: %s", service.Spec.IPFamilies, m, target.Spec.IPFamilies, err)
+		service.Spec.IPFamilies = target.Spec.IPFamilies
+		service.Spec.IPFamilyPolicy = target.Spec.IPFamilyPolicy
+		service.Spec.ClusterIPs = target.Spec.ClusterIPs
+		_, err = targetCS.CoreV1().Services(m.DestinationNamespace).Update(ctx, service, metav1.UpdateOptions{})
+	}
+	if k8serror.IsInvalid(err) && service.Spec.Type != target.Spec.Type {
+		// older API servers reject some type changes, e.g. from ClusterIP to ExternalName
+		logrus.Warnf("destination rejected changing the type of service %s/%s from %s to %s: %s", target.Namespace, target.Name, target.Spec.Type, service.Spec.Type, err)
+		err = recreateService(ctx, target, service, m, targetCS)
+		recreated = err == nil
+	}
+	recordSync(m, "service", err)
 	if err != nil {
 		logrus.Errorf("error while updating target service: %s", err)
+		return false, err
+	}
+	return recreated, nil
+}
+
+//recreateService replaces the target service by service to apply changes of immutable fields. Only services that are
+//already managed by servicesync are recreated, and the target is deleted with a precondition on its UID so that a
+//service that was replaced in the meantime is left alone. The new service gets new cluster IPs.
+func recreateService(ctx context.Context, target, service *corev1.Service, m Mapping, cs kubernetes.Interface) error {
+	if !isManaged(target) {
+		return fmt.Errorf("target service %s/%s has to be recreated for mapping %s but is not managed by servicesync yet, delete it to have it created", target.Namespace, target.Name, m)
+	}
+	logrus.Warnf("recreating target service %s/%s of mapping %s to change it from %s to %s", target.Namespace, target.Name, m, describeServiceType(target), describeServiceType(service))
+	err := cs.CoreV1().Services(target.Namespace).Delete(ctx, target.Name, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(target.UID))})
+	if err != nil && !k8serror.IsNotFound(err) {
+		logrus.Errorf("error while deleting target service for recreation: %s", err)
+		return err
+	}
+	service = service.DeepCopy()
+	service.ResourceVersion = ""
+	if !isHeadless(service) {
+		service.Spec.ClusterIP = ""
+	}
+	service.Spec.ClusterIPs = nil
+	created, err := cs.CoreV1().Services(service.Namespace).Create(ctx, service, metav1.CreateOptions{})
+	if err != nil {
+		logrus.Errorf("error while creating recreated target service: %s", err)
 		return err
 	}
+	eventRecorder(cs).Eventf(created, corev1.EventTypeNormal, "Recreated", "recreated by servicesync to change it from %s to %s", describeServiceType(target), describeServiceType(created))
 	return nil
 }
 
-func transformService(source, target *corev1.Service) *corev1.Service {
+//describeServiceType returns the type of the service, or Headless for a headless service.
+func describeServiceType(s *corev1.Service) string {
+	if isHeadless(s) {
+		return string(DestinationTypeHeadless)
+	}
+	if s.Spec.Type == "" {
+		return string(corev1.ServiceTypeClusterIP)
+	}
+	return string(s.Spec.Type)
+}
+
+//transformService copies the ports, type and IP families of the source service onto the target service. The cluster IP
+//of the target is kept unless the destination type of the mapping requires a different one. In node-port and
+//load-balancer mode the ports target the node ports or load balancer ports of the source.
+func transformService(source, target *corev1.Service, m Mapping) *corev1.Service {
 	transformed := corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            target.Name,
@@ -99,9 +258,131 @@ func transformService(source, target *corev1.Service) *corev1.Service {
 		Spec: corev1.ServiceSpec{
 			ClusterIP:   target.Spec.ClusterIP,
 			Ports:       source.Spec.Ports,
-			Type:        source.Spec.Type,
 			ExternalIPs: source.Spec.ExternalIPs,
 		},
 	}
+	switch m.EndpointMode {
+	case EndpointModeNodePort:
+		transformed.Spec.Ports = nodePortServicePorts(source.Spec.Ports)
+	case EndpointModeLoadBalancer:
+		transformed.Spec.Ports = loadBalancerServicePorts(source.Spec.Ports)
+	}
+	if target.Spec.Type == corev1.ServiceTypeExternalName || isHeadless(target) {
+		// a cluster IP is allocated for the new type
+		transformed.Spec.ClusterIP = ""
+	}
+	switch t := destinationType(source, m); t {
+	case DestinationTypeHeadless:
+		transformed.Spec.Type = corev1.ServiceTypeClusterIP
+		transformed.Spec.ClusterIP = corev1.ClusterIPNone
+		transformed.Spec.ExternalIPs = nil
+		transformed.Spec.PublishNotReadyAddresses = source.Spec.PublishNotReadyAddresses
+		transformed.Spec.Ports = withoutNodePorts(transformed.Spec.Ports)
+	case DestinationTypeExternalName:
+		transformed.Spec.Type = corev1.ServiceTypeExternalName
+		transformed.Spec.ExternalName = m.ExternalName
+		if transformed.Spec.ExternalName == "" {
+			transformed.Spec.ExternalName = source.Spec.ExternalName
+		}
+		transformed.Spec.ClusterIP = ""
+		transformed.Spec.ExternalIPs = nil
+		transformed.Spec.Ports = withoutNodePorts(transformed.Spec.Ports)
+		// ExternalName services have neither cluster IPs nor IP families
+		return &transformed
+	case DestinationTypeNodePort, DestinationTypeLoadBalancer:
+		transformed.Spec.Type = corev1.ServiceType(t)
+		if m.DestinationType == t {
+			// the node ports of the source are not necessarily free in the destination
+			transformed.Spec.Ports = allocatedNodePorts(transformed.Spec.Ports, target.Spec.Ports)
+		}
+	default:
+		transformed.Spec.Type = corev1.ServiceTypeClusterIP
+		transformed.Spec.Ports = withoutNodePorts(transformed.Spec.Ports)
+	}
+	transformIPFamilies(source, target, &transformed, m.IPFamilies)
 	return &transformed
 }
+
+//destinationType returns the type of the destination service. Without a destination type on the mapping the type of
+//the source service is used, except that load-balancer mode does not provision a load balancer in the destination. Alias
+//mode always results in an ExternalName service.
+func destinationType(source *corev1.Service, m Mapping) DestinationType {
+	if m.EndpointMode == EndpointModeAlias {
+		return DestinationTypeExternalName
+	}
+	if m.Headless {
+		return DestinationTypeHeadless
+	}
+	if m.DestinationType != "" && m.DestinationType != DestinationTypeSource {
+		return m.DestinationType
+	}
+	switch {
+	case source.Spec.Type == corev1.ServiceTypeExternalName:
+		return DestinationTypeExternalName
+	case isHeadless(source):
+		return DestinationTypeHeadless
+	case source.Spec.Type == corev1.ServiceTypeNodePort:
+		return DestinationTypeNodePort
+	case source.Spec.Type == corev1.ServiceTypeLoadBalancer && m.EndpointMode != EndpointModeLoadBalancer:
+		return DestinationTypeLoadBalancer
+	}
+	return DestinationTypeClusterIP
+}
+
+//withoutNodePorts clears the node ports, which only NodePort and LoadBalancer services may have.
+func withoutNodePorts(ports []corev1.ServicePort) []corev1.ServicePort {
+	var transformed []corev1.ServicePort
+	for _, p := range ports {
+		p.NodePort = 0
+		transformed = append(transformed, p)
+	}
+	return transformed
+}
+
+//allocatedNodePorts keeps the node ports the destination already allocated for the ports, other node ports are left to
+//be allocated by the destination.
+func allocatedNodePorts(ports, targetPorts []corev1.ServicePort) []corev1.ServicePort {
+	var transformed []corev1.ServicePort
+	for _, p := range ports {
+		p.NodePort = 0
+		for _, t := range targetPorts {
+			if t.Port == p.Port && t.Protocol == p.Protocol {
+				p.NodePort = t.NodePort
+			}
+		}
+		transformed = append(transformed, p)
+	}
+	return transformed
+}
+
+//isHeadless returns whether the service has no cluster IP.
+func isHeadless(s *corev1.Service) bool {
+	return s.Spec.ClusterIP == corev1.ClusterIPNone
+}
+
+func checkServiceOwnership(target *corev1.Service, m Mapping, cs kubernetes.Interface) error {
+	err := checkOwnership("service", target, m)
+	if conflict, ok := err.(*ConflictError); ok {
+		recordConflict(cs, target, conflict)
+	}
+	return err
+}
+
+//DeleteService deletes the target service if it is managed by servicesync. A service that does not exist is not an
+//error.
+func DeleteService(ctx context.Context, namespace, targetName string, cs kubernetes.Interface) error {
+	target, err := cs.CoreV1().Services(namespace).Get(ctx, targetName, metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !isManaged(target) {
+		return &ConflictError{Kind: "service", Namespace: namespace, Name: targetName, Reason: "is not managed by servicesync"}
+	}
+	err = cs.CoreV1().Services(namespace).Delete(ctx, targetName, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(target.UID))})
+	if err != nil && !k8serror.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
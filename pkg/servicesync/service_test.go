@@ -2,14 +2,18 @@ package servicesync
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestEnsureServiceNotFound(t *testing.T) {
@@ -17,7 +21,7 @@ func TestEnsureServiceNotFound(t *testing.T) {
 	targetName := "fooService"
 	cs := fake.NewSimpleClientset()
 	ctx := context.Background()
-	err := EnsureService(ctx, namespace, targetName, cs)
+	err := EnsureService(ctx, Mapping{DestinationNamespace: namespace, DestinationName: targetName}, cs)
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,7 +64,7 @@ func TestGetAndUpdateService(t *testing.T) {
 			Namespace: targetNamespace,
 		},
 	})
-	err := GetAndUpdateService(ctx, sourceNamespace, sourceName, targetNamespace, targetName, sourceCS, targetCS)
+	err := GetAndUpdateService(ctx, Mapping{SourceNamespace: sourceNamespace, SourceName: sourceName, DestinationNamespace: targetNamespace, DestinationName: targetName, Adopt: true}, sourceCS, targetCS)
 	if err != nil {
 		t.Error(err)
 	}
@@ -106,7 +110,7 @@ func TestSyncService(t *testing.T) {
 			Namespace: targetNamespace,
 		},
 	})
-	if err := SyncService(ctx, sourceNamespace, sourceName, targetNamespace, targetName, sourceCS, targetCS); err != nil {
+	if _, err := SyncService(ctx, Mapping{SourceNamespace: sourceNamespace, SourceName: sourceName, DestinationNamespace: targetNamespace, DestinationName: targetName, Adopt: true}, sourceCS, targetCS); err != nil {
 		t.Error(err)
 	}
 	patch := []byte(`{
@@ -138,3 +142,207 @@ func TestSyncService(t *testing.T) {
 		}
 	}
 }
+
+func TestSyncServiceRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	targetNamespace := "bar"
+	targetName := "barService"
+	sourceNamespace := "foo"
+	sourceName := "fooService"
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sourceName,
+			Namespace: sourceNamespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name: "http",
+					Port: 81,
+				},
+			},
+		},
+	})
+	targetCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      targetName,
+			Namespace: targetNamespace,
+		},
+	})
+	// the first update fails
+	failed := false
+	targetCS.PrependReactor("update", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !failed {
+			failed = true
+			return true, nil, errors.New("update failed")
+		}
+		return false, nil, nil
+	})
+	if _, err := SyncService(ctx, Mapping{SourceNamespace: sourceNamespace, SourceName: sourceName, DestinationNamespace: targetNamespace, DestinationName: targetName, Adopt: true}, sourceCS, targetCS); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(sleepLength)
+	s, err := targetCS.CoreV1().Services(targetNamespace).Get(ctx, targetName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Spec.Ports) != 1 || s.Spec.Ports[0].Port != 81 {
+		t.Errorf("failed update was not retried: %v", s.Spec.Ports)
+	}
+}
+
+func TestSyncServiceShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	targetNamespace := "bar"
+	targetName := "barService"
+	sourceNamespace := "foo"
+	sourceName := "fooService"
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sourceName,
+			Namespace: sourceNamespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name: "http",
+					Port: 81,
+				},
+			},
+		},
+	})
+	targetCS := fake.NewSimpleClientset()
+	// the update is still in flight when the sync is stopped
+	updating := make(chan struct{})
+	var once sync.Once
+	targetCS.PrependReactor("update", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		once.Do(func() { close(updating) })
+		time.Sleep(sleepLength)
+		return false, nil, nil
+	})
+	done, err := SyncService(ctx, Mapping{SourceNamespace: sourceNamespace, SourceName: sourceName, DestinationNamespace: targetNamespace, DestinationName: targetName}, sourceCS, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-updating
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * sleepLength):
+		t.Fatal("sync did not stop")
+	}
+	s, err := targetCS.CoreV1().Services(targetNamespace).Get(context.Background(), targetName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Spec.Ports) != 1 || s.Spec.Ports[0].Port != 81 {
+		t.Errorf("update in flight was not completed: %v", s.Spec.Ports)
+	}
+}
+
+func TestTransformServiceDestinationType(t *testing.T) {
+	source := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	target := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type:      corev1.ServiceTypeNodePort,
+			ClusterIP: "10.0.0.1",
+			Ports:     []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 31080}},
+		},
+	}
+	tests := []struct {
+		destinationType DestinationType
+		wantType        corev1.ServiceType
+		wantClusterIP   string
+		wantNodePort    int32
+	}{
+		{DestinationTypeSource, corev1.ServiceTypeLoadBalancer, "10.0.0.1", 30080},
+		{DestinationTypeClusterIP, corev1.ServiceTypeClusterIP, "10.0.0.1", 0},
+		{DestinationTypeHeadless, corev1.ServiceTypeClusterIP, corev1.ClusterIPNone, 0},
+		{DestinationTypeNodePort, corev1.ServiceTypeNodePort, "10.0.0.1", 31080},
+		{DestinationTypeLoadBalancer, corev1.ServiceTypeLoadBalancer, "10.0.0.1", 31080},
+		{DestinationTypeExternalName, corev1.ServiceTypeExternalName, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.destinationType), func(t *testing.T) {
+			m := Mapping{DestinationType: tt.destinationType, ExternalName: "foo.example.com"}
+			m.setDefaults()
+			transformed := transformService(source, target, m)
+			if transformed.Spec.Type != tt.wantType || transformed.Spec.ClusterIP != tt.wantClusterIP {
+				t.Errorf("expected type %s with cluster IP %q, got %s with %q", tt.wantType, tt.wantClusterIP, transformed.Spec.Type, transformed.Spec.ClusterIP)
+			}
+			if p := transformed.Spec.Ports[0].NodePort; p != tt.wantNodePort {
+				t.Errorf("expected node port %d, got %d", tt.wantNodePort, p)
+			}
+		})
+	}
+}
+
+func TestSyncServiceDestinationTypeRecreate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Mapping{SourceNamespace: "foo", SourceName: "fooService", DestinationNamespace: "bar", DestinationName: "barService"}
+	// the source becomes headless
+	sourceCS := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []corev1.ServicePort{{Port: 80}},
+		},
+	}, &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+		Subsets: []corev1.EndpointSubset{{Addresses: []corev1.EndpointAddress{{IP: "1.2.3.4"}}}},
+	})
+	targetCS := fake.NewSimpleClientset()
+	// the endpoints are deleted along with the old service, as the endpoints controller would. The reactor is installed
+	// before the syncers use the client set.
+	targetCS.PrependReactor("delete", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		targetCS.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("endpoints"), "bar", "barService")
+		return false, nil, nil
+	})
+	done, err := StartMapping(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sourceCS.CoreV1().Services("foo").Update(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fooService",
+			Namespace: "foo",
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Ports:     []corev1.ServicePort{{Port: 80}},
+		},
+	}, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleepLength)
+	s, err := targetCS.CoreV1().Services("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHeadless(s) {
+		t.Errorf("expected the target service to be recreated headless")
+	}
+	e, err := targetCS.CoreV1().Endpoints("bar").Get(ctx, "barService", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Subsets) != 1 {
+		t.Errorf("expected the endpoints to be restored, got %v", e.Subsets)
+	}
+	cancel()
+	<-done
+}
@@ -2,48 +2,330 @@ package servicesync
 
 import (
 	"context"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
 )
 
-func Run(v *viper.Viper) {
-	// create service and endpoint
-	ctx := context.Background()
+//Run synchronizes the configured mappings, discoveries and export until ctx is done. It returns once the syncs in
+//flight have completed.
+func Run(ctx context.Context, v *viper.Viper) {
+	ServeMetrics(v)
+	ServeHealth(v)
+	ConfigureResolver(v)
+	ConfigureDryRun(v)
+	runWithLeaderElection(ctx, v, func(ctx context.Context) {
+		run(ctx, v)
+	})
+	logrus.Info("stopped")
+}
+
+//run starts all configured mappings, discoveries and the export and waits for them to stop once ctx is done.
+func run(ctx context.Context, v *viper.Viper) {
+	mappings, err := MappingsFromConfig(v)
+	if err != nil {
+		logrus.Fatalf("unexpected error while reading mappings: %s", err)
+	}
 	targetCS, err := kubernetes.NewForConfig(v.Get("destination-kube-config").(*rest.Config))
 	if err != nil {
 		logrus.Fatalf("unexpected error while creating destination client set: %s", err)
 	}
-	err = EnsureService(ctx, v.GetString("destination-namespace"), v.GetString("rename-service"), targetCS)
+	sourceCS, err := kubernetes.NewForConfig(v.Get("source-kube-config").(*rest.Config))
 	if err != nil {
-		logrus.Fatalf("unexpected error while ensuring service: %s", err)
+		logrus.Fatalf("error while building source cluster client set: %s", err)
 	}
-	err = EnsureEndpoints(ctx, v.GetString("destination-namespace"), v.GetString("rename-service"), targetCS)
+
+	discoveries, err := DiscoveriesFromConfig(v)
 	if err != nil {
-		logrus.Fatalf("unexpected error while ensuring endpoints: %s", err)
+		logrus.Fatalf("unexpected error while reading discovery: %s", err)
 	}
-	sourceCS, err := kubernetes.NewForConfig(v.Get("source-kube-config").(*rest.Config))
+	export, err := ExportFromConfig(v)
 	if err != nil {
-		logrus.Fatalf("error while building source cluster client set: %s", err)
+		logrus.Fatalf("unexpected error while reading export: %s", err)
 	}
 
-	err = GetAndUpdateService(ctx, v.GetString("source-namespace"), v.GetString("service"), v.GetString("destination-namespace"), v.GetString("rename-service"), sourceCS, targetCS)
-	if err != nil {
-		logrus.Fatalf("error while initially updating service: %s", err)
+	mgr := NewManager(v.GetString("source-cluster-name"), sourceCS, targetCS)
+	validMappings, startedMappings := 0, 0
+	var multiClusterLock sync.Mutex
+	var multiCluster []<-chan struct{}
+	// pending is done once every valid mapping has started, mappings that fail to start are retried until then
+	var pending sync.WaitGroup
+	for _, m := range mappings {
+		m := m
+		dm := m
+		dm.setDefaults()
+		if err := dm.validate(); err != nil {
+			logrus.Errorf("invalid mapping %s: %s", m, err)
+			continue
+		}
+		validMappings++
+		start := func() error {
+			return mgr.Start(ctx, m)
+		}
+		if len(m.Destinations) > 0 || len(m.Sources) > 0 {
+			start = func() error {
+				done, err := startMultiCluster(ctx, v, m, sourceCS, targetCS)
+				if err != nil {
+					return err
+				}
+				multiClusterLock.Lock()
+				multiCluster = append(multiCluster, done)
+				multiClusterLock.Unlock()
+				return nil
+			}
+		}
+		if err := start(); err != nil {
+			logrus.Errorf("could not start mapping %s, retrying: %s", m, err)
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				retryStart(ctx, "mapping "+m.String(), start)
+			}()
+			continue
+		}
+		startedMappings++
+	}
+	startedDiscoveries := 0
+	for _, d := range discoveries {
+		if err := RunDiscovery(ctx, d, mgr); err != nil {
+			logrus.Errorf("could not start discovery: %s", err)
+			continue
+		}
+		startedDiscoveries++
+	}
+	if export != nil {
+		if err := RunExport(ctx, *export, mgr); err != nil {
+			logrus.Fatalf("could not start export: %s", err)
+		}
+		logrus.Infof("exporting services annotated with %s=true", ExportAnnotation)
+	}
+	if validMappings+startedDiscoveries == 0 && export == nil {
+		logrus.Fatalf("none of the %d configured mappings and %d discoveries could be started", len(mappings), len(discoveries))
+	}
+	logrus.Infof("started %d of %d mappings and %d of %d discoveries", startedMappings, len(mappings), startedDiscoveries, len(discoveries))
+	// ready once the initial sync of every valid mapping succeeded, see SetReady
+	readyDone := make(chan struct{})
+	go func() {
+		defer close(readyDone)
+		pending.Wait()
+		if ctx.Err() == nil {
+			logrus.Infof("all %d valid mappings started", validMappings)
+			health.SetReady(true)
+		}
+	}()
+
+	if interval := v.GetDuration("gc-interval"); interval > 0 {
+		configured := map[string]bool{}
+		for _, m := range mappings {
+			configured[m.String()] = true
+			// the destination objects do not record the destination cluster, which may be this one
+			for _, d := range m.Destinations {
+				dm := m.forDestination(d)
+				dm.DestinationCluster = ""
+				configured[dm.String()] = true
+			}
+		}
+		// configured mappings that failed to start are still in use
+		inUse := func(m Mapping) bool {
+			return configured[m.String()] || mgr.Running(m)
+		}
+		go RunGarbageCollection(ctx, interval, v.GetString("source-cluster-name"), inUse, targetCS, v.GetBool("gc-dry-run"))
+	}
+
+	<-ctx.Done()
+	<-readyDone
+	health.SetReady(false)
+	logrus.Info("shutting down, waiting for syncs in flight")
+	mgr.Wait()
+	<-joined(multiCluster...)
+}
+
+//startBackoff is the backoff between attempts to start something that failed to start.
+func startBackoff() wait.Backoff {
+	return wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: math.MaxInt32, Cap: 5 * time.Minute}
+}
+
+//retryStart calls start with backoff until it succeeds or ctx is done. It returns whether start succeeded.
+func retryStart(ctx context.Context, what string, start func() error) bool {
+	backoff := startBackoff()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff.Step()):
+		}
+		err := start()
+		if err == nil {
+			logrus.Infof("started %s", what)
+			return true
+		}
+		logrus.Errorf("could not start %s, retrying: %s", what, err)
+	}
+}
+
+//runWithRetry calls start until it succeeds or ctx is done, with backoff between the attempts, and then waits for what
+//it started to stop. Every attempt is started with a context of its own that is cancelled if the attempt fails, so that
+//nothing a failed attempt started keeps running.
+func runWithRetry(ctx context.Context, what string, start func(ctx context.Context) (<-chan struct{}, error)) {
+	backoff := startBackoff()
+	for {
+		actx, cancel := context.WithCancel(ctx)
+		done, err := start(actx)
+		if err == nil {
+			logrus.Infof("started %s", what)
+			<-done
+			cancel()
+			return
+		}
+		cancel()
+		logrus.Errorf("could not start %s, retrying: %s", what, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+//startMultiCluster starts a mapping with several destination clusters, see StartFanOut, or with several source
+//clusters, see StartMerge.
+func startMultiCluster(ctx context.Context, v *viper.Viper, m Mapping, sourceCS, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	m.SourceCluster = v.GetString("source-cluster-name")
+	if len(m.Sources) > 0 {
+		sources, err := sourceClientSets(m)
+		if err != nil {
+			return nil, err
+		}
+		return StartMerge(ctx, m, sources, targetCS)
 	}
-	err = GetAndUpdateEndpoints(ctx, v.GetString("source-namespace"), v.GetString("service"), v.GetString("destination-namespace"), v.GetString("rename-service"), sourceCS, targetCS)
+	targets, err := targetClientSets(m)
 	if err != nil {
-		logrus.Fatalf("error while initially updating endpoints: %s", err)
+		return nil, err
+	}
+	return StartFanOut(ctx, m, sourceCS, targets)
+}
+
+//StartMapping creates the destination service and endpoints for a mapping, does an initial sync and then keeps them in
+//sync with the source. The returned channel is closed once ctx is done and the mapping has stopped.
+func StartMapping(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) (<-chan struct{}, error) {
+	m.setDefaults()
+	if err := syncMapping(ctx, m, sourceCS, targetCS); err != nil {
+		return nil, err
 	}
 
 	// sync services and endpoints on startup
-	SyncService(ctx, v.GetString("source-namespace"), v.GetString("service"), v.GetString("destination-namespace"), v.GetString("rename-service"), sourceCS, targetCS)
-	SyncEndpoints(ctx, v.GetString("source-namespace"), v.GetString("service"), v.GetString("destination-namespace"), v.GetString("rename-service"), sourceCS, targetCS)
+	serviceDone, err := SyncService(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		return nil, err
+	}
+	if m.EndpointMode == EndpointModeAlias {
+		return serviceDone, nil
+	}
+	var localDone <-chan struct{}
+	if m.LocalSelector != "" {
+		// the source endpoints are merged with the local pods from now on
+		m, localDone, err = SyncLocalEndpoints(ctx, m, targetCS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var endpointsDone <-chan struct{}
+	switch {
+	case m.EndpointMode == EndpointModeNodePort:
+		endpointsDone, err = SyncNodePortEndpoints(ctx, m, sourceCS, targetCS)
+	case m.EndpointMode == EndpointModeLoadBalancer:
+		endpointsDone, err = SyncLoadBalancerEndpoints(ctx, m, sourceCS, targetCS)
+	case m.EndpointSlices:
+		endpointsDone, err = SyncEndpointSlices(ctx, m, sourceCS, targetCS)
+	default:
+		endpointsDone, err = SyncEndpoints(ctx, m, sourceCS, targetCS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if localDone != nil {
+		return joined(serviceDone, localDone, endpointsDone), nil
+	}
+	return joined(serviceDone, endpointsDone), nil
+}
+
+//syncMapping validates the mapping, creates the destination service and endpoints and does a one time sync of them.
+func syncMapping(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	m.setDefaults()
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if len(m.Sources) > 0 {
+		// the service is synced from the first source, see StartMerge
+		sources, err := sourceClientSets(m)
+		if err != nil {
+			return err
+		}
+		m.sourceClients = sources
+		sourceCS = sources[m.Sources[0].Name]
+	}
+	// create service and endpoint
+	err := EnsureService(ctx, m, targetCS)
+	if err != nil {
+		logrus.Errorf("unexpected error while ensuring service: %s", err)
+		return err
+	}
+	if !m.EndpointSlices && m.EndpointMode != EndpointModeAlias {
+		err = EnsureEndpoints(ctx, m, targetCS)
+		if err != nil {
+			logrus.Errorf("unexpected error while ensuring endpoints: %s", err)
+			return err
+		}
+	}
+
+	err = GetAndUpdateService(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		logrus.Errorf("error while initially updating service: %s", err)
+		return err
+	}
+	err = getAndUpdateEndpoints(ctx, m, sourceCS, targetCS)
+	if err != nil {
+		logrus.Errorf("error while initially updating endpoints: %s", err)
+		return err
+	}
+	return nil
+}
+
+//getAndUpdateEndpoints does a one time sync of the target endpoints or EndpointSlices, depending on the endpoint mode of
+//the mapping.
+func getAndUpdateEndpoints(ctx context.Context, m Mapping, sourceCS, targetCS kubernetes.Interface) error {
+	switch {
+	case len(m.Sources) > 0:
+		return getAndUpdateMergedEndpoints(ctx, m, targetCS)
+	case m.EndpointMode == EndpointModeNodePort:
+		return GetAndUpdateNodePortEndpoints(ctx, m, sourceCS, targetCS)
+	case m.EndpointMode == EndpointModeLoadBalancer:
+		return GetAndUpdateLoadBalancerEndpoints(ctx, m, sourceCS, targetCS)
+	case m.EndpointMode == EndpointModeAlias:
+		// the destination is an ExternalName service without endpoints
+		return nil
+	case m.EndpointSlices:
+		return GetAndUpdateEndpointSlices(ctx, m, sourceCS, targetCS)
+	}
+	return GetAndUpdateEndpoints(ctx, m, sourceCS, targetCS)
+}
 
-	// sleep forever
-	<-(chan int)(nil)
+//joined returns a channel that is closed once all of chans are closed.
+func joined(chans ...<-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for _, c := range chans {
+			<-c
+		}
+		close(done)
+	}()
+	return done
 }